@@ -0,0 +1,385 @@
+package base
+
+import (
+	"sync"
+	"time"
+	log "github.com/sotter/dovenet/log"
+)
+
+type BreakerState int
+
+const (
+	BREAKER_CLOSED BreakerState = iota // 正常放行
+	BREAKER_OPEN                       // 熔断，直接拒绝
+	BREAKER_HALF_OPEN                  // 放行少量探测请求，全部成功后恢复
+)
+
+func (this BreakerState) String() string {
+	switch this {
+	case BREAKER_CLOSED:
+		return "closed"
+	case BREAKER_OPEN:
+		return "open"
+	case BREAKER_HALF_OPEN:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+//熔断策略，对TransPortClient中每个组的每个后端地址分别统计
+//  - Window内请求数达到MinRequests并且失败率达到FailureRate时熔断
+//  - Call的耗时超过SlowCall也算失败，为0时不检查
+//  - 熔断OpenTimeout后进入半开，放行HalfOpenProbes个请求，全部成功后恢复，有一个失败重新熔断
+type BreakerPolicy struct {
+	Window         time.Duration
+	MinRequests    int
+	FailureRate    float64
+	SlowCall       time.Duration
+	OpenTimeout    time.Duration
+	HalfOpenProbes int
+
+	//状态变化时调用，在发送或者读协程中，不能阻塞；调用时没有持有熔断器的锁，可以读取BreakerStats
+	OnStateChange  func(group string, address string, from BreakerState, to BreakerState)
+}
+
+func DefaultBreakerPolicy() BreakerPolicy {
+	return BreakerPolicy{
+		Window:         10 * time.Second,
+		MinRequests:    20,
+		FailureRate:    0.5,
+		OpenTimeout:    30 * time.Second,
+		HalfOpenProbes: 3,
+	}
+}
+
+//熔断的统计
+type BreakerStats struct {
+	Group    string
+	Address  string
+	State    BreakerState
+	Requests int    // 当前窗口内的请求数
+	Failures int    // 当前窗口内的失败数
+	Opens    uint64 // 累计熔断次数
+	Rejected uint64 // 累计被拒绝的请求数
+}
+
+type Breaker struct {
+	lock        sync.Mutex
+	policy      *BreakerPolicy
+	group       string
+	address     string
+
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int // 半开状态下已经放行的请求
+	probeOk     int // 半开状态下成功的请求
+
+	opens       uint64
+	rejected    uint64
+}
+
+func newBreaker(policy *BreakerPolicy, group string, address string) *Breaker {
+	return &Breaker{
+		policy:      policy,
+		group:       group,
+		address:     address,
+		windowStart: time.Now(),
+	}
+}
+
+func (this *Breaker) State() BreakerState {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.state
+}
+
+//不改变状态，只判断能否被选中，用于连接选择
+func (this *Breaker) allowing() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	switch this.state {
+	case BREAKER_OPEN:
+		return time.Since(this.openedAt) >= this.policy.OpenTimeout
+	case BREAKER_HALF_OPEN:
+		return this.probes < this.policy.HalfOpenProbes
+	default:
+		return true
+	}
+}
+
+//请求发出前调用，返回false时请求被拒绝
+func (this *Breaker) allow() bool {
+	this.lock.Lock()
+	ok, notify := this.allowLocked()
+	this.lock.Unlock()
+
+	notify()
+	return ok
+}
+
+func (this *Breaker) allowLocked() (bool, func()) {
+	switch this.state {
+	case BREAKER_OPEN:
+		if time.Since(this.openedAt) < this.policy.OpenTimeout {
+			this.rejected++
+			return false, noNotify
+		}
+		notify := this.setState(BREAKER_HALF_OPEN)
+		this.probes = 1
+		return true, notify
+	case BREAKER_HALF_OPEN:
+		if this.probes >= this.policy.HalfOpenProbes {
+			this.rejected++
+			return false, noNotify
+		}
+		this.probes++
+		return true, noNotify
+	default:
+		return true, noNotify
+	}
+}
+
+func (this *Breaker) onSuccess() {
+	this.lock.Lock()
+	notify := noNotify
+	switch this.state {
+	case BREAKER_HALF_OPEN:
+		this.probeOk++
+		if this.probeOk >= this.policy.HalfOpenProbes {
+			notify = this.setState(BREAKER_CLOSED)
+		}
+	case BREAKER_CLOSED:
+		this.roll()
+		this.requests++
+	}
+	this.lock.Unlock()
+
+	notify()
+}
+
+func (this *Breaker) onFailure() {
+	this.lock.Lock()
+	notify := noNotify
+	switch this.state {
+	case BREAKER_HALF_OPEN:
+		notify = this.setState(BREAKER_OPEN)
+	case BREAKER_CLOSED:
+		this.roll()
+		this.requests++
+		this.failures++
+		if this.requests >= this.policy.MinRequests &&
+			float64(this.failures) >= float64(this.requests) * this.policy.FailureRate {
+			notify = this.setState(BREAKER_OPEN)
+		}
+	}
+	this.lock.Unlock()
+
+	notify()
+}
+
+//窗口到期后重新统计
+func (this *Breaker) roll() {
+	if time.Since(this.windowStart) >= this.policy.Window {
+		this.windowStart = time.Now()
+		this.requests = 0
+		this.failures = 0
+	}
+}
+
+func noNotify() {}
+
+//调用时持有lock，返回的函数调用OnStateChange，需要在释放lock之后调用，回调中可以再访问熔断器
+func (this *Breaker) setState(state BreakerState) func() {
+	from := this.state
+	if from == state {
+		return noNotify
+	}
+	this.state = state
+
+	switch state {
+	case BREAKER_OPEN:
+		this.openedAt = time.Now()
+		this.opens++
+	case BREAKER_CLOSED:
+		this.windowStart = time.Now()
+		this.requests = 0
+		this.failures = 0
+	}
+	this.probes = 0
+	this.probeOk = 0
+
+	log.Println("CircuitBreaker -> ", this.group, " ", this.address, " ", from, " -> ", state)
+	onStateChange := this.policy.OnStateChange
+	if onStateChange == nil {
+		return noNotify
+	}
+	group, address := this.group, this.address
+	return func() {
+		onStateChange(group, address, from, state)
+	}
+}
+
+func (this *Breaker) Stats() BreakerStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return BreakerStats{
+		Group:    this.group,
+		Address:  this.address,
+		State:    this.state,
+		Requests: this.requests,
+		Failures: this.failures,
+		Opens:    this.opens,
+		Rejected: this.rejected,
+	}
+}
+
+//连接上的熔断器，同一个地址的连接共用一个
+func (this *TcpConnection) getBreaker() *Breaker {
+	if b, ok := this.breaker.Load().(*Breaker); ok {
+		return b
+	}
+	return nil
+}
+
+//熔断器是否放行，没有开启熔断时总是放行
+func (this *TcpConnection) breakerAllowing() bool {
+	if b := this.getBreaker(); b != nil {
+		return b.allowing()
+	}
+	return true
+}
+
+//取得（没有时创建）address对应的熔断器
+func (this *ServerConnGroup) breakerFor(policy *BreakerPolicy, address string) *Breaker {
+	this.memberLock.Lock()
+	defer this.memberLock.Unlock()
+
+	if this.breakers == nil {
+		this.breakers = make(map[string]*Breaker)
+	}
+	b, exist := this.breakers[address]
+	if !exist {
+		b = newBreaker(policy, this.name, address)
+		this.breakers[address] = b
+	}
+	return b
+}
+
+//组内有熔断中的地址
+func (this *ServerConnGroup) anyBreakerOpen() bool {
+	this.memberLock.Lock()
+	defer this.memberLock.Unlock()
+	for _, b := range this.breakers {
+		if b.State() != BREAKER_CLOSED {
+			return true
+		}
+	}
+	return false
+}
+
+//开启熔断，对已有和之后建立的连接都生效
+func (this *TransPortClient) EnableCircuitBreaker(policy BreakerPolicy) {
+	defaults := DefaultBreakerPolicy()
+	if policy.Window <= 0 {
+		policy.Window = defaults.Window
+	}
+	if policy.MinRequests <= 0 {
+		policy.MinRequests = defaults.MinRequests
+	}
+	if policy.FailureRate <= 0 {
+		policy.FailureRate = defaults.FailureRate
+	}
+	if policy.OpenTimeout <= 0 {
+		policy.OpenTimeout = defaults.OpenTimeout
+	}
+	if policy.HalfOpenProbes <= 0 {
+		policy.HalfOpenProbes = defaults.HalfOpenProbes
+	}
+
+	this.lock.Lock()
+	this.breakerPolicy = &policy
+	groups := append([]*ServerConnGroup(nil), this.connGroups...)
+	this.lock.Unlock()
+
+	for _, group := range groups {
+		for _, conn := range group.Manager.Sessions() {
+			this.attachBreaker(group, conn)
+		}
+	}
+}
+
+//连接加入组时关联熔断器
+func (this *TransPortClient) attachBreaker(group *ServerConnGroup, conn *TcpConnection) {
+	this.lock.RLock()
+	policy := this.breakerPolicy
+	this.lock.RUnlock()
+
+	if policy == nil {
+		return
+	}
+	conn.breaker.Store(group.breakerFor(policy, conn.Address))
+}
+
+//请求发出前检查熔断器
+func (this *TransPortClient) breakerAllow(conn *TcpConnection) bool {
+	if b := conn.getBreaker(); b != nil {
+		return b.allow()
+	}
+	return true
+}
+
+//请求的结果计入熔断器
+func (this *TransPortClient) breakerDone(conn *TcpConnection, ok bool) {
+	b := conn.getBreaker()
+	if b == nil {
+		return
+	}
+	if ok {
+		b.onSuccess()
+	} else {
+		b.onFailure()
+	}
+}
+
+//Call的耗时超过BreakerPolicy.SlowCall
+func (this *TransPortClient) slowCall(elapsed time.Duration) bool {
+	this.lock.RLock()
+	policy := this.breakerPolicy
+	this.lock.RUnlock()
+	return policy != nil && policy.SlowCall > 0 && elapsed > policy.SlowCall
+}
+
+//没有连接可选时，区分是熔断还是确实没有连接
+func (this *TransPortClient) noConnError(name string) error {
+	if group := this.group(name); group != nil && group.anyBreakerOpen() {
+		return ErrorCircuitOpen
+	}
+	return ErrorNoConnection
+}
+
+//所有地址的熔断统计
+func (this *TransPortClient) BreakerStats() []BreakerStats {
+	this.lock.RLock()
+	groups := append([]*ServerConnGroup(nil), this.connGroups...)
+	this.lock.RUnlock()
+
+	var stats []BreakerStats
+	for _, group := range groups {
+		group.memberLock.Lock()
+		breakers := make([]*Breaker, 0, len(group.breakers))
+		for _, b := range group.breakers {
+			breakers = append(breakers, b)
+		}
+		group.memberLock.Unlock()
+
+		for _, b := range breakers {
+			stats = append(stats, b.Stats())
+		}
+	}
+	return stats
+}
@@ -0,0 +1,89 @@
+package base
+
+import (
+	"testing"
+	"time"
+)
+
+type stateChange struct {
+	from BreakerState
+	to   BreakerState
+}
+
+func TestBreakerStateChange(t *testing.T) {
+	var changes []stateChange
+	var breaker *Breaker
+	policy := &BreakerPolicy{
+		Window:         time.Minute,
+		MinRequests:    4,
+		FailureRate:    0.5,
+		OpenTimeout:    20 * time.Millisecond,
+		HalfOpenProbes: 2,
+	}
+	//回调中访问熔断器，持有锁时调用会死锁
+	policy.OnStateChange = func(group string, address string, from BreakerState, to BreakerState) {
+		if group != "g" || address != "a:1" {
+			t.Errorf("OnStateChange for %s %s", group, address)
+		}
+		if state := breaker.Stats().State; state != to {
+			t.Errorf("state in callback = %v, want %v", state, to)
+		}
+		changes = append(changes, stateChange{from, to})
+	}
+	breaker = newBreaker(policy, "g", "a:1")
+
+	//请求数不够时不熔断
+	breaker.onSuccess()
+	breaker.onFailure()
+	breaker.onFailure()
+	if state := breaker.State(); state != BREAKER_CLOSED {
+		t.Fatalf("state = %v before MinRequests, want closed", state)
+	}
+	breaker.onSuccess()
+	breaker.onFailure()
+	if state := breaker.State(); state != BREAKER_OPEN {
+		t.Fatalf("state = %v at failure rate, want open", state)
+	}
+	if breaker.allow() {
+		t.Fatal("open breaker allowed a request")
+	}
+
+	//半开失败重新熔断
+	time.Sleep(policy.OpenTimeout)
+	if !breaker.allow() {
+		t.Fatal("half-open breaker rejected the first probe")
+	}
+	breaker.onFailure()
+
+	//半开的探测全部成功后恢复
+	time.Sleep(policy.OpenTimeout)
+	if !breaker.allow() || !breaker.allow() {
+		t.Fatal("half-open breaker rejected a probe")
+	}
+	if breaker.allow() {
+		t.Fatal("half-open breaker allowed more than HalfOpenProbes")
+	}
+	breaker.onSuccess()
+	breaker.onSuccess()
+
+	want := []stateChange{
+		{BREAKER_CLOSED, BREAKER_OPEN},
+		{BREAKER_OPEN, BREAKER_HALF_OPEN},
+		{BREAKER_HALF_OPEN, BREAKER_OPEN},
+		{BREAKER_OPEN, BREAKER_HALF_OPEN},
+		{BREAKER_HALF_OPEN, BREAKER_CLOSED},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("change %d = %v, want %v", i, changes[i], want[i])
+		}
+	}
+
+	stats := breaker.Stats()
+	if stats.Opens != 2 || stats.Rejected != 2 || stats.Requests != 0 {
+		t.Errorf("stats %+v, want 2 opens, 2 rejected and a fresh window", stats)
+	}
+}
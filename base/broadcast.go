@@ -0,0 +1,99 @@
+package base
+
+import (
+	"sync"
+	"time"
+	"github.com/sotter/dovenet/protocol"
+)
+
+//消息投递到一个连接的结果
+type DeliveryStatus uint8
+
+const (
+	DELIVERY_SENT    DeliveryStatus = iota // 已放入发送队列
+	DELIVERY_DROPPED                       // 发送队列已满，丢弃
+	DELIVERY_CLOSED                        // 连接已经关闭
+)
+
+func (this DeliveryStatus) String() string {
+	switch this {
+	case DELIVERY_SENT:
+		return "sent"
+	case DELIVERY_DROPPED:
+		return "dropped"
+	case DELIVERY_CLOSED:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+type BroadcastResult struct {
+	Conn   *TcpConnection
+	Status DeliveryStatus
+}
+
+//广播的选项
+//  Filter      : 只发给返回true的连接，为nil时发给所有连接
+//  Timeout     : 发送队列满时最多等待的时间，为0时不等待直接丢弃
+//  Concurrency : Timeout大于0时并发投递的协程数，避免一个慢连接拖住整个广播，默认为1
+type BroadcastOption struct {
+	Filter      func(*TcpConnection) bool
+	Timeout     time.Duration
+	Concurrency int
+}
+
+//广播给conns中的连接，消息只编码一次
+func broadcast(conns []*TcpConnection, msg protocol.Message, opt *BroadcastOption) []BroadcastResult {
+	if opt == nil {
+		opt = &BroadcastOption{}
+	}
+	if _, ok := msg.(*protocol.EncodedMsg); !ok {
+		msg = protocol.NewEncodedMsg(msg)
+	}
+
+	targets := conns[:0]
+	for _, conn := range conns {
+		if opt.Filter == nil || opt.Filter(conn) {
+			targets = append(targets, conn)
+		}
+	}
+
+	results := make([]BroadcastResult, len(targets))
+	deliver := func(i int) {
+		conn := targets[i]
+		results[i].Conn = conn
+		if opt.Timeout > 0 {
+			results[i].Status = conn.TryWriteTimeout(msg, opt.Timeout)
+		} else {
+			results[i].Status = conn.TryWrite(msg)
+		}
+	}
+
+	concurrency := opt.Concurrency
+	if opt.Timeout <= 0 || concurrency <= 1 {
+		for i := range targets {
+			deliver(i)
+		}
+		return results
+	}
+
+	var wg sync.WaitGroup
+	index := make(chan int)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range index {
+				deliver(i)
+			}
+		}()
+	}
+	for i := range targets {
+		index <- i
+	}
+	close(index)
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,55 @@
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sotter/dovenet/protocol"
+)
+
+func TestBroadcastStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  *BroadcastOption
+	}{
+		{"no wait", nil},
+		{"concurrent", &BroadcastOption{Timeout: 10 * time.Millisecond, Concurrency: 3}},
+	}
+
+	for _, test := range tests {
+		//发送队列长度为1，连接不启动，消息留在队列中
+		sent := NewClientConn(1, nil, 1, nopCallBack{})
+		full := NewClientConn(2, nil, 1, nopCallBack{})
+		full.TryWrite(protocol.NewCommMsg(1, nil))
+		closed := newManagedConn(NewManager(), 3, "")
+		closed.Close()
+		filtered := NewClientConn(4, nil, 1, nopCallBack{})
+
+		opt := test.opt
+		if opt == nil {
+			opt = &BroadcastOption{}
+		}
+		opt.Filter = func(conn *TcpConnection) bool {
+			return conn != filtered
+		}
+
+		want := map[*TcpConnection]DeliveryStatus{
+			sent:   DELIVERY_SENT,
+			full:   DELIVERY_DROPPED,
+			closed: DELIVERY_CLOSED,
+		}
+		results := broadcast([]*TcpConnection{sent, full, closed, filtered}, protocol.NewCommMsg(2, []byte("x")), opt)
+		if len(results) != len(want) {
+			t.Errorf("%s: %d results, want %d", test.name, len(results), len(want))
+		}
+		for _, result := range results {
+			if status, exist := want[result.Conn]; !exist || result.Status != status {
+				t.Errorf("%s: conn %d status %v, want %v", test.name, result.Conn.ConnID, result.Status, status)
+			}
+		}
+
+		if queued, ok := (<-sent.messageSendChan).(*protocol.EncodedMsg); !ok {
+			t.Errorf("%s: queued %T, want the shared *protocol.EncodedMsg", test.name, queued)
+		}
+	}
+}
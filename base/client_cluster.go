@@ -3,6 +3,7 @@ package  base
 import (
 	"errors"
 	"sync"
+	"time"
 	"github.com/sotter/dovenet/protocol"
 	log "github.com/sotter/dovenet/log"
 )
@@ -12,6 +13,24 @@ type ServerConnGroup struct {
 	stop        chan bool
 	name        string
 	Manager     *Manager    //派发方式在Manage中实现
+
+	//由TransPortClient维护连接的成员地址，见client_member.go
+	memberLock  sync.Mutex
+	members     map[string]uint64 // 地址 -> 加入时的代数
+	memberGen   uint64
+
+	//每个地址的熔断器，见breaker.go，由memberLock保护
+	breakers    map[string]*Breaker
+
+	//每个地址的连接数策略和正在建立的连接数，见client_pool.go，由memberLock保护
+	pool        *PoolPolicy
+	dialing     map[string]int
+
+	//最近Call的耗时，用于对冲请求的分位数，见hedge.go
+	latency     latencyWindow
+
+	//发送限制，见client_limit.go，由memberLock保护
+	limiter     *groupLimiter
 }
 
 //TCP Client管理的总入口，所有的客户端可以用一个全局的TransPortClient来管理
@@ -21,6 +40,26 @@ type TransPortClient struct {
 	connsIndex	map[string]int
 	once        *sync.Once
 	lock        sync.RWMutex
+
+	Registry    *protocol.TypeRegistry // SendTyped使用的类型注册表，为nil时使用protocol.DefaultRegistry
+
+	//AddAddress/SetAddresses由TransPortClient自己建立连接时使用的参数
+	Protocol          protocol.Protocol
+	NetworkCB         NetworkCallBack
+	ChanSize          uint32
+	WorkNum           int
+	DialTimeout       time.Duration
+	ReconnectInterval time.Duration   // 连接失败或者断开后重连的间隔
+	DrainTimeout      time.Duration   // 删除成员时等待发送队列和未回应请求清空的最长时间
+
+	health            *HealthPolicy   // EnableHealthCheck之后不为nil
+	breakerPolicy     *BreakerPolicy  // EnableCircuitBreaker之后不为nil
+	retry             *RetryPolicy    // SetRetryPolicy之后不为nil
+	retryBudget       *retryBudget
+	retryStats        RetryStats
+	pool              *PoolPolicy     // SetDefaultPoolPolicy之后不为nil
+	poolOnce          sync.Once
+	hedgeStats        HedgeStats
 }
 
 func NewServerConnGroup(name string) *ServerConnGroup {
@@ -28,6 +67,7 @@ func NewServerConnGroup(name string) *ServerConnGroup {
 		stop : make(chan bool),
 		name : name,
 		Manager: NewManager(),
+		members: make(map[string]uint64),
 	}
 }
 
@@ -36,6 +76,13 @@ func NewTransPortClient() *TransPortClient {
 		stop : make(chan bool, 1),
 		connsIndex : make(map[string]int),
 		once : &sync.Once{},
+
+		Protocol : &protocol.CommProtocol{},
+		ChanSize : 1024,
+		WorkNum : 1,
+		DialTimeout : 5 * time.Second,
+		ReconnectInterval : 5 * time.Second,
+		DrainTimeout : 5 * time.Second,
 	}
 
 	return tps
@@ -48,17 +95,17 @@ func (this *TransPortClient)RegisterConnServer(tcpConn *TcpConnection) (err erro
 	//如果没有这个Manager，那么注册下这个manager
 	this.RegisterConnGroup(tcpConn.Name)
 
-	this.lock.RLock()
-	defer this.lock.RUnlock()
-	index, exist:= this.connsIndex[tcpConn.Name]
-	if exist {
-		this.connGroups[index].Manager.PutSession(tcpConn)
-		tcpConn.ConnManager = this.connGroups[index].Manager
-	} else {
+	group := this.group(tcpConn.Name)
+	if group == nil {
 		log.Println("Server Name ", tcpConn.Name, " can not find")
 		return errors.New("Can find Server Name")
 	}
 
+	//先关联熔断器再放入Manager，避免在关联之前被选中
+	this.attachBreaker(group, tcpConn)
+	group.Manager.PutSession(tcpConn)
+	tcpConn.ConnManager = group.Manager
+
 	return err
 }
 
@@ -75,6 +122,26 @@ func (this *TransPortClient)GetTcpConnection(name string, connid uint64)  *TcpCo
 	return this.connGroups[index].Manager.GetSession(connid)
 }
 
+//name对应的一组连接，不存在时返回nil
+func (this *TransPortClient)group(name string) *ServerConnGroup {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	index, exist := this.connsIndex[name]
+	if !exist {
+		return nil
+	}
+	return this.connGroups[index]
+}
+
+//name对应的一组连接的Manager，不存在时返回nil
+func (this *TransPortClient)groupManager(name string) *Manager {
+	if group := this.group(name); group != nil {
+		return group.Manager
+	}
+	return nil
+}
+
 //注册一个新的ClientName
 func (this *TransPortClient)RegisterConnGroup(name string) {
 	this.lock.Lock()
@@ -89,48 +156,172 @@ func (this *TransPortClient)RegisterConnGroup(name string) {
 	this.connsIndex[name] =  len(this.connGroups) - 1
 }
 
+//立即关闭name中地址为address的连接，组内的其他连接不受影响；需要等待发送完的用RemoveAddress
 func (this *TransPortClient)RemoveByAddress(name string, address string) {
-	this.lock.Lock()
-	index, exist := this.connsIndex[name]
-	if exist == false {
+	group := this.group(name)
+	if group == nil {
 		log.Println("RemoveByAddress :", name, " is not exist!")
-		this.lock.Unlock()
 		return
-	} else {
-		conns := this.connGroups[index].Manager.GetSessionByAddress(address)
-		delete(this.connsIndex, name)
-		this.lock.Unlock()
-
-		for _, conn := range conns {
-			conn.Reconnect = false
-			conn.Close()
-		}
+	}
+
+	group.removeMember(address)
+	for _, conn := range group.Manager.GetSessionByAddress(address) {
+		conn.Reconnect = false
+		conn.Close()
 	}
 }
 
 //一层一层的往下关闭
 func (this *TransPortClient)Stop() {
-	n := len(this.connGroups)
-	for i := 0; i < n; i++ {
-		this.connGroups[i].Manager.Dispose()
+	this.once.Do(func() {
+		close(this.stop)
+	})
+
+	this.lock.RLock()
+	groups := append([]*ServerConnGroup(nil), this.connGroups...)
+	this.lock.RUnlock()
+
+	for _, group := range groups {
+		group.Manager.Dispose()
 	}
 }
 
+//轮询选择一个连接发送，设置了RetryPolicy时，失败会换一个连接重试，见retry.go；
+//设置了LimitPolicy时先按限制等待，见client_limit.go
 func (this *TransPortClient)SendData(name string, msg protocol.Message) error {
 	defer RecoverPrint()
 
-	this.lock.RLock()
-	var tcpConn *TcpConnection = nil
-	index, exist := this.connsIndex[name]
-	if exist {
-		tcpConn = this.connGroups[index].Manager.GetRotationSession()
+	release, err := this.acquireLimit(name)
+	if err != nil {
+		return err
 	}
-	this.lock.RUnlock()
+	tracked := &trackedMsg{Message: msg, done: release}
+
+	retry := this.retryEnabled()
+	status := DELIVERY_DROPPED
+	err = this.withRetry(name, func(tcpConn *TcpConnection) (err error) {
+		status, err = this.sendOnce(tcpConn, tracked, retry)
+		return err
+	}, func(err error) bool {
+		return true
+	})
 
-	if tcpConn != nil {
-		return tcpConn.Write(msg)
-	} else {
-		return errors.New("No Tcpconnecion can use.")
+	//没有放入发送队列，writeLoop不会结束这个请求
+	if status != DELIVERY_SENT {
+		release()
+	}
+	return err
+}
+
+//retry为false时保持原来的行为：队列满时丢弃，返回nil
+func (this *TransPortClient)sendOnce(tcpConn *TcpConnection, msg protocol.Message, retry bool) (DeliveryStatus, error) {
+	if !this.breakerAllow(tcpConn) {
+		return DELIVERY_DROPPED, ErrorCircuitOpen
+	}
+
+	switch tcpConn.TryWrite(msg) {
+	case DELIVERY_DROPPED:
+		//发送队列满说明对端处理不过来，计入健康检查和熔断
+		log.Println("messageSendChan is full , Write Lost packet !!! ", tcpConn.String())
+		this.reportFailure(tcpConn)
+		if retry {
+			return DELIVERY_DROPPED, ErrorWouldBlock
+		}
+		return DELIVERY_DROPPED, nil
+	case DELIVERY_CLOSED:
+		this.breakerDone(tcpConn, false)
+		return DELIVERY_CLOSED, ErrorConnClosed
+	default:
+		this.breakerDone(tcpConn, true)
+		return DELIVERY_SENT, nil
+	}
+}
+
+//同步请求，从name对应的一组连接中选一个发送msg并等待回应，见TcpConnection.Request
+//  - 带FlagError的回应返回*RemoteError，reply同时返回
+//  - 超时和发送失败计入健康检查和熔断，熔断中的地址不会被选中
+//  - 设置了RetryPolicy时，没有发出去的请求换一个连接重试，已经发出去的只有幂等的MsgType才重试；
+//    timeout是每一次尝试的超时
+func (this *TransPortClient)Call(name string, msg *protocol.CommMsg, timeout time.Duration) (*protocol.CommMsg, error) {
+	release, err := this.acquireLimit(name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var reply *protocol.CommMsg
+	var sent bool
+
+	err = this.withRetry(name, func(tcpConn *TcpConnection) (err error) {
+		reply, sent, err = this.callOnce(tcpConn, msg, timeout)
+		return err
+	}, func(err error) bool {
+		if _, remote := err.(*RemoteError); remote {
+			return false
+		}
+		return !sent || this.idempotent(msg.Header.MsgType)
+	})
+	return reply, err
+}
+
+//sent表示请求已经发出去了
+func (this *TransPortClient)callOnce(tcpConn *TcpConnection, msg *protocol.CommMsg,
+	timeout time.Duration) (*protocol.CommMsg, bool, error) {
+
+	type result struct {
+		reply *protocol.CommMsg
+		sent  bool
+		err   error
+	}
+	done := make(chan result, 1)
+	this.callAsync(tcpConn, msg, timeout, func(reply *protocol.CommMsg, sent bool, err error) {
+		done <- result{reply, sent, err}
+	})
+	res := <-done
+	return res.reply, res.sent, res.err
+}
+
+//在指定的连接上发出请求，结果计入延迟统计、健康检查和熔断，callback的参数和callOnce的返回值相同
+//callback可能在调用者、读协程或者定时器协程中调用，不能阻塞
+func (this *TransPortClient)callAsync(tcpConn *TcpConnection, msg *protocol.CommMsg, timeout time.Duration,
+	callback func(reply *protocol.CommMsg, sent bool, err error)) {
+
+	//连接配置的问题，不算作对端的失败
+	if !tcpConn.SeqSupported() {
+		callback(nil, false, ErrorNoSeq)
+		return
+	}
+	if !this.breakerAllow(tcpConn) {
+		callback(nil, false, ErrorCircuitOpen)
+		return
+	}
+	start := time.Now()
+
+	err := tcpConn.Request(msg, timeout, func(reply *protocol.CommMsg, err error) {
+		if err != nil {
+			this.reportFailure(tcpConn)
+			callback(nil, true, err)
+			return
+		}
+
+		//错误回应说明对端是活的；太慢的回应只计入熔断
+		elapsed := time.Since(start)
+		this.recordLatency(tcpConn.Name, elapsed)
+		if this.slowCall(elapsed) {
+			this.healthSuccess(tcpConn)
+			this.breakerDone(tcpConn, false)
+		} else {
+			this.reportSuccess(tcpConn)
+		}
+		if reply.Header.Flags & protocol.FlagError != 0 {
+			callback(reply, true, &RemoteError{MsgType: reply.Header.MsgType, Message: string(reply.Body)})
+			return
+		}
+		callback(reply, true, nil)
+	})
+	if err != nil {
+		this.reportFailure(tcpConn)
+		callback(nil, false, err)
 	}
 }
 
@@ -145,24 +336,46 @@ func (this *TransPortClient)SendDataWouldBlock(name string, msg protocol.Message
 	}
 	this.lock.RUnlock()
 
-	if tcpConn != nil {
-		return tcpConn.WriteWouldBlock(msg)
-	} else {
-		return errors.New("No Tcpconnecion can use.")
+	if tcpConn == nil {
+		return ErrorNoConnection
 	}
+
+	release, err := this.acquireLimit(name)
+	if err != nil {
+		return err
+	}
+	if err = tcpConn.WriteWouldBlock(&trackedMsg{Message: msg, done: release}); err != nil {
+		release()
+	}
+	return err
 }
 
 func (this *TransPortClient)BroadCast(name string, msg protocol.Message) error {
+	_, err := this.BroadcastWith(name, msg, nil)
+	return err
+}
+
+//广播给name对应的一组连接，返回每个连接的投递结果
+func (this *TransPortClient)BroadcastWith(name string, msg protocol.Message, opt *BroadcastOption) ([]BroadcastResult, error) {
 	defer RecoverPrint()
 
-	this.lock.RLock()
-	index, exist := this.connsIndex[name]
-	if exist {
-		this.connGroups[index].Manager.BroadcastRun(func(conn *TcpConnection){
-			conn.Write(msg)
-		})
+	manager := this.groupManager(name)
+	if manager == nil {
+		return nil, errors.New("Can find Server Name")
 	}
-	this.lock.RUnlock()
+	return manager.Broadcast(msg, opt), nil
+}
 
-	return nil
+//按Registry中注册的MsgType编码v，然后发送给name对应的一组连接
+func (this *TransPortClient)SendTyped(name string, v interface{}) error {
+	registry := this.Registry
+	if registry == nil {
+		registry = protocol.DefaultRegistry
+	}
+
+	msg, err := registry.Encode(v)
+	if err != nil {
+		return err
+	}
+	return this.SendData(name, msg)
 }
@@ -0,0 +1,171 @@
+package base
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/sotter/dovenet/protocol"
+)
+
+//超过限制时的处理方式
+const (
+	LIMIT_BLOCK = iota      // 一直等待
+	LIMIT_FAIL_FAST         // 立即返回ErrorRateLimited
+	LIMIT_QUEUE_TIMEOUT     // 最多等待Timeout，超时返回ErrorRateLimited
+)
+
+//一个组的发送限制，对SendData、SendDataWouldBlock、SendTyped、Call和CallHedged生效
+//  - Rate是每秒的请求数（令牌桶），Burst是桶的容量，Rate为0时不限制速率
+//  - MaxInFlight是同时进行中的请求数，为0时不限制；发送的消息在writeLoop写出后结束，Call在收到回应后结束
+type LimitPolicy struct {
+	Rate        float64
+	Burst       int
+	MaxInFlight int
+	Mode        int
+	Timeout     time.Duration
+}
+
+//限制的统计
+type LimitStats struct {
+	InFlight int
+	Rejected uint64 // 因为超过限制返回ErrorRateLimited的请求数
+}
+
+type groupLimiter struct {
+	policy   LimitPolicy
+	bucket   *tokenBucket // Rate为0时为nil
+	inflight chan struct{}
+	rejected uint64
+}
+
+func newGroupLimiter(policy LimitPolicy) *groupLimiter {
+	limiter := &groupLimiter{
+		policy: policy,
+	}
+	if policy.Rate > 0 {
+		limiter.bucket = newTokenBucket(policy.Rate, policy.Burst)
+	}
+	if policy.MaxInFlight > 0 {
+		limiter.inflight = make(chan struct{}, policy.MaxInFlight)
+	}
+	return limiter
+}
+
+//开始一个请求，成功时返回结束请求时调用的release（可以调用多次）
+func (this *groupLimiter) acquire() (func(), error) {
+	var deadline time.Time
+	switch this.policy.Mode {
+	case LIMIT_QUEUE_TIMEOUT:
+		deadline = time.Now().Add(this.policy.Timeout)
+	}
+
+	release := func() {}
+	if this.inflight != nil {
+		if !this.acquireSlot(deadline) {
+			atomic.AddUint64(&this.rejected, 1)
+			return nil, ErrorRateLimited
+		}
+		var once sync.Once
+		release = func() {
+			once.Do(func() {
+				<-this.inflight
+			})
+		}
+	}
+
+	if this.bucket != nil {
+		maxWait := time.Duration(-1)
+		switch this.policy.Mode {
+		case LIMIT_FAIL_FAST:
+			maxWait = 0
+		case LIMIT_QUEUE_TIMEOUT:
+			if maxWait = time.Until(deadline); maxWait < 0 {
+				maxWait = 0
+			}
+		}
+
+		wait, ok := this.bucket.take(1, maxWait)
+		if !ok {
+			release()
+			atomic.AddUint64(&this.rejected, 1)
+			return nil, ErrorRateLimited
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return release, nil
+}
+
+func (this *groupLimiter) acquireSlot(deadline time.Time) bool {
+	switch this.policy.Mode {
+	case LIMIT_FAIL_FAST:
+		select {
+		case this.inflight <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	case LIMIT_QUEUE_TIMEOUT:
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		select {
+		case this.inflight <- struct{}{}:
+			return true
+		case <-timer.C:
+			return false
+		}
+	default:
+		this.inflight <- struct{}{}
+		return true
+	}
+}
+
+//设置name对应的组的发送限制，policy为nil时取消限制
+func (this *TransPortClient) SetLimitPolicy(name string, policy *LimitPolicy) {
+	this.RegisterConnGroup(name)
+	group := this.group(name)
+
+	group.memberLock.Lock()
+	defer group.memberLock.Unlock()
+	if policy == nil {
+		group.limiter = nil
+	} else {
+		group.limiter = newGroupLimiter(*policy)
+	}
+}
+
+func (this *TransPortClient) LimitStats(name string) LimitStats {
+	limiter := this.limiter(name)
+	if limiter == nil {
+		return LimitStats{}
+	}
+	return LimitStats{
+		InFlight: len(limiter.inflight),
+		Rejected: atomic.LoadUint64(&limiter.rejected),
+	}
+}
+
+func (this *TransPortClient) limiter(name string) *groupLimiter {
+	group := this.group(name)
+	if group == nil {
+		return nil
+	}
+	group.memberLock.Lock()
+	defer group.memberLock.Unlock()
+	return group.limiter
+}
+
+//按name的限制开始一个请求，没有设置限制时release什么都不做
+func (this *TransPortClient) acquireLimit(name string) (func(), error) {
+	if limiter := this.limiter(name); limiter != nil {
+		return limiter.acquire()
+	}
+	return func() {}, nil
+}
+
+//写出后（或者连接关闭时）结束请求的消息，由writeLoop拆开后再交给Codec
+type trackedMsg struct {
+	protocol.Message
+	done func()
+}
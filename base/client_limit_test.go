@@ -0,0 +1,61 @@
+package base
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupLimiterInFlight(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    int
+		blocked time.Duration // 第二个请求的最短等待时间
+		err     error
+	}{
+		{"fail fast", LIMIT_FAIL_FAST, 0, ErrorRateLimited},
+		{"queue timeout", LIMIT_QUEUE_TIMEOUT, 20 * time.Millisecond, ErrorRateLimited},
+	}
+
+	for _, test := range tests {
+		limiter := newGroupLimiter(LimitPolicy{MaxInFlight: 1, Mode: test.mode, Timeout: 20 * time.Millisecond})
+		release, err := limiter.acquire()
+		if err != nil {
+			t.Fatalf("%s: first acquire: %v", test.name, err)
+		}
+
+		start := time.Now()
+		if _, err := limiter.acquire(); err != test.err {
+			t.Errorf("%s: second acquire err = %v, want %v", test.name, err, test.err)
+		}
+		if elapsed := time.Since(start); elapsed < test.blocked {
+			t.Errorf("%s: rejected after %v, want at least %v", test.name, elapsed, test.blocked)
+		}
+
+		//release可以调用多次，只释放一个名额
+		release()
+		release()
+		if len(limiter.inflight) != 0 || limiter.rejected != 1 {
+			t.Errorf("%s: inflight %d rejected %d, want 0 and 1", test.name, len(limiter.inflight), limiter.rejected)
+		}
+		if _, err := limiter.acquire(); err != nil {
+			t.Errorf("%s: acquire after release: %v", test.name, err)
+		}
+	}
+}
+
+// 速率被拒绝时退回进行中的名额
+func TestGroupLimiterRate(t *testing.T) {
+	limiter := newGroupLimiter(LimitPolicy{Rate: 1, Burst: 1, MaxInFlight: 2, Mode: LIMIT_FAIL_FAST})
+	release, err := limiter.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	if _, err := limiter.acquire(); err != ErrorRateLimited {
+		t.Errorf("acquire beyond rate err = %v, want ErrorRateLimited", err)
+	}
+	if len(limiter.inflight) != 0 {
+		t.Errorf("inflight = %d after rate rejection, want 0", len(limiter.inflight))
+	}
+}
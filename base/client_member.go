@@ -0,0 +1,193 @@
+package base
+
+import (
+	"net"
+	"time"
+	"github.com/sotter/dovenet/protocol"
+	log "github.com/sotter/dovenet/log"
+)
+
+//每次加入时分配一个新的代数，地址被删除后又加回来时，旧连接的代数和现在的不一样
+func (this *ServerConnGroup) addMember(address string) bool {
+	this.memberLock.Lock()
+	defer this.memberLock.Unlock()
+	if this.members[address] != 0 {
+		return false
+	}
+	this.memberGen++
+	this.members[address] = this.memberGen
+	return true
+}
+
+func (this *ServerConnGroup) removeMember(address string) bool {
+	this.memberLock.Lock()
+	defer this.memberLock.Unlock()
+	if this.members[address] == 0 {
+		return false
+	}
+	delete(this.members, address)
+	delete(this.breakers, address)
+	return true
+}
+
+func (this *ServerConnGroup) isMember(address string) bool {
+	return this.generation(address) != 0
+}
+
+//address当前的代数，不是成员时为0
+func (this *ServerConnGroup) generation(address string) uint64 {
+	this.memberLock.Lock()
+	defer this.memberLock.Unlock()
+	return this.members[address]
+}
+
+func (this *ServerConnGroup) Members() []string {
+	this.memberLock.Lock()
+	defer this.memberLock.Unlock()
+
+	addresses := make([]string, 0, len(this.members))
+	for address := range this.members {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+//TransPortClient自己建立的连接使用的回调：先通知业务层，再按成员关系决定是否重连
+type memberCallBack struct {
+	client *TransPortClient
+	group  *ServerConnGroup
+	gen    uint64 // 建立连接时地址的代数
+}
+
+func (this *memberCallBack) OnMessageData(conn *TcpConnection, msg protocol.Message) error {
+	if this.client.NetworkCB != nil {
+		return this.client.NetworkCB.OnMessageData(conn, msg)
+	}
+	return nil
+}
+
+func (this *memberCallBack) OnConnection(conn *TcpConnection) {
+	if this.client.NetworkCB != nil {
+		this.client.NetworkCB.OnConnection(conn)
+	}
+}
+
+func (this *memberCallBack) OnDisConnection(conn *TcpConnection) {
+	if this.client.NetworkCB != nil {
+		this.client.NetworkCB.OnDisConnection(conn)
+	}
+
+	//还是组内成员的地址，断开后重连；地址被删除后又加回来时，由重新加入时建立的连接负责，这里不再重连
+	if this.group.generation(conn.Address) == this.gen {
+		this.client.redial(this.group, conn.Address)
+	}
+}
+
+func (this *TransPortClient) stopped() bool {
+	select {
+	case <-this.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (this *TransPortClient) redial(group *ServerConnGroup, address string) {
+	time.AfterFunc(this.ReconnectInterval, func() {
+		this.fill(group, address)
+	})
+}
+
+//建立一个到address的连接，调用前已经startDialLocked；失败时按ReconnectInterval重新补齐，直到地址不再是组内成员
+func (this *TransPortClient) dial(group *ServerConnGroup, address string) {
+	defer group.doneDial(address)
+
+	if this.stopped() || !group.isMember(address) {
+		return
+	}
+
+	dest, err := net.DialTimeout("tcp", address, this.DialTimeout)
+	if err != nil {
+		log.Println("TransPortClient dial ", group.name, " ", address, " : ", err.Error())
+		this.redial(group, address)
+		return
+	}
+
+	//连接建立期间地址被删除了
+	gen := group.generation(address)
+	if this.stopped() || gen == 0 {
+		dest.Close()
+		return
+	}
+
+	tcpConn := NewClientConn(GetNetId(), this.Protocol.NewCodec(dest), this.ChanSize,
+		&memberCallBack{client: this, group: group, gen: gen})
+	tcpConn.Name = group.name
+	tcpConn.Address = address
+	tcpConn.WorkNum = this.WorkNum
+	//重连由成员关系决定，业务层的OnDisConnection不需要再处理
+	tcpConn.Reconnect = false
+
+	if err := this.RegisterConnServer(tcpConn); err != nil {
+		dest.Close()
+		this.redial(group, address)
+		return
+	}
+	tcpConn.Start()
+}
+
+//给name增加一个后端地址，异步建立连接（个数见PoolPolicy），断开后自动重连
+func (this *TransPortClient) AddAddress(name string, address string) {
+	this.RegisterConnGroup(name)
+	group := this.group(name)
+	if group.addMember(address) {
+		log.Println("TransPortClient AddAddress ", name, " ", address)
+		this.fill(group, address)
+	}
+}
+
+//从name中删除一个后端地址，对应的连接不再被选中，等发送队列和未回应的请求清空（最多DrainTimeout）后关闭
+func (this *TransPortClient) RemoveAddress(name string, address string) {
+	group := this.group(name)
+	if group == nil {
+		return
+	}
+
+	group.removeMember(address)
+	log.Println("TransPortClient RemoveAddress ", name, " ", address)
+	for _, conn := range group.Manager.GetSessionByAddress(address) {
+		conn.Reconnect = false
+		//先标记排空，地址马上又加回来时，这些连接不会被算作已有的连接
+		conn.startDrain()
+		go conn.Drain(this.DrainTimeout)
+	}
+}
+
+//把name的成员设置为addresses：新增的地址建立连接，删除的地址排空后关闭，组本身一直保留
+func (this *TransPortClient) SetAddresses(name string, addresses []string) {
+	this.RegisterConnGroup(name)
+	group := this.group(name)
+
+	desired := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		desired[address] = true
+	}
+
+	for _, address := range group.Members() {
+		if !desired[address] {
+			this.RemoveAddress(name, address)
+		}
+	}
+	for address := range desired {
+		this.AddAddress(name, address)
+	}
+}
+
+//name当前的成员地址
+func (this *TransPortClient) Addresses(name string) []string {
+	group := this.group(name)
+	if group == nil {
+		return nil
+	}
+	return group.Members()
+}
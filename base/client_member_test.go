@@ -0,0 +1,56 @@
+package base
+
+import (
+	"sort"
+	"testing"
+)
+
+//地址删除后又加回来时代数变化，旧连接的代数不再有效
+func TestMemberGeneration(t *testing.T) {
+	client := NewTransPortClient()
+	client.RegisterConnGroup("g")
+	group := client.group("g")
+
+	if !group.addMember("a:1") || group.addMember("a:1") {
+		t.Fatal("addMember should only succeed once")
+	}
+	group.addMember("b:1")
+	old := group.generation("a:1")
+
+	if !group.removeMember("a:1") || group.removeMember("a:1") || group.isMember("a:1") {
+		t.Fatal("removeMember should only succeed once")
+	}
+	group.addMember("a:1")
+	if gen := group.generation("a:1"); gen == old || gen == 0 {
+		t.Errorf("generation after re-add = %d, old %d", gen, old)
+	}
+
+	members := client.Addresses("g")
+	sort.Strings(members)
+	if len(members) != 2 || members[0] != "a:1" || members[1] != "b:1" {
+		t.Errorf("members = %v", members)
+	}
+}
+
+//RemoveAddress只排空这个地址的连接
+func TestRemoveAddressDrains(t *testing.T) {
+	client := NewTransPortClient()
+	client.RegisterConnGroup("g")
+	group := client.group("g")
+	group.addMember("a:1")
+	group.addMember("b:1")
+
+	removed := newManagedConn(group.Manager, 1, "a:1")
+	kept := newManagedConn(group.Manager, 2, "b:1")
+	client.RemoveAddress("g", "a:1")
+
+	if !removed.IsDraining() || removed.Reconnect {
+		t.Errorf("conn of the removed address not draining")
+	}
+	if kept.IsDraining() {
+		t.Errorf("conn of another address draining")
+	}
+	if members := client.Addresses("g"); len(members) != 1 || members[0] != "b:1" {
+		t.Errorf("members = %v, want [b:1]", members)
+	}
+}
@@ -0,0 +1,225 @@
+package base
+
+import (
+	"sync/atomic"
+	"time"
+	log "github.com/sotter/dovenet/log"
+)
+
+//一个后端地址的连接数，由TransPortClient的维护协程调整
+//  - 至少保持Min个连接，断开后按ReconnectInterval补齐
+//  - 地址所有连接的发送队列平均长度达到GrowQueueLen时增加一个连接，最多Max个
+//  - 超过Min的连接IdleTimeout内没有发送数据时排空后关闭，每次检查最多关闭一个
+type PoolPolicy struct {
+	Min          int
+	Max          int
+	GrowQueueLen int
+	IdleTimeout  time.Duration
+}
+
+//不设置时每个地址一个连接，和原来的行为一致
+func DefaultPoolPolicy() PoolPolicy {
+	return PoolPolicy{
+		Min:         1,
+		Max:         1,
+		IdleTimeout: 60 * time.Second,
+	}
+}
+
+//维护协程的检查间隔
+var poolCheckInterval = time.Second
+
+//设置所有没有单独设置的组使用的连接数策略
+func (this *TransPortClient) SetDefaultPoolPolicy(policy PoolPolicy) {
+	policy = this.fixPoolPolicy(policy)
+
+	this.lock.Lock()
+	this.pool = &policy
+	this.lock.Unlock()
+
+	this.startPoolLoop()
+}
+
+//设置name对应的组每个地址的连接数策略
+func (this *TransPortClient) SetPoolPolicy(name string, policy PoolPolicy) {
+	policy = this.fixPoolPolicy(policy)
+
+	this.RegisterConnGroup(name)
+	group := this.group(name)
+	group.memberLock.Lock()
+	group.pool = &policy
+	group.memberLock.Unlock()
+
+	this.startPoolLoop()
+}
+
+func (this *TransPortClient) fixPoolPolicy(policy PoolPolicy) PoolPolicy {
+	defaults := DefaultPoolPolicy()
+	if policy.Min <= 0 {
+		policy.Min = defaults.Min
+	}
+	if policy.Max < policy.Min {
+		policy.Max = policy.Min
+	}
+	if policy.GrowQueueLen <= 0 {
+		policy.GrowQueueLen = int(this.ChanSize / 2) + 1
+	}
+	if policy.IdleTimeout <= 0 {
+		policy.IdleTimeout = defaults.IdleTimeout
+	}
+	return policy
+}
+
+func (this *TransPortClient) startPoolLoop() {
+	this.poolOnce.Do(func() {
+		go this.poolLoop()
+	})
+}
+
+//组的连接数策略，调用时持有group.memberLock
+func (this *TransPortClient) poolPolicyLocked(group *ServerConnGroup) PoolPolicy {
+	if group.pool != nil {
+		return *group.pool
+	}
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if this.pool != nil {
+		return *this.pool
+	}
+	return DefaultPoolPolicy()
+}
+
+//address上还在使用的连接，不包括正在排空的
+func (this *ServerConnGroup) addressConns(address string) []*TcpConnection {
+	var conns []*TcpConnection
+	for _, conn := range this.Manager.GetSessionByAddress(address) {
+		if !conn.IsClosed() && !conn.IsDraining() {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+//调用时持有group.memberLock
+func (this *ServerConnGroup) startDialLocked(address string) {
+	if this.dialing == nil {
+		this.dialing = make(map[string]int)
+	}
+	this.dialing[address]++
+}
+
+func (this *ServerConnGroup) doneDial(address string) {
+	this.memberLock.Lock()
+	defer this.memberLock.Unlock()
+	if this.dialing[address]--; this.dialing[address] <= 0 {
+		delete(this.dialing, address)
+	}
+}
+
+//把address的连接补齐到Min个
+func (this *TransPortClient) fill(group *ServerConnGroup, address string) {
+	if this.stopped() {
+		return
+	}
+
+	group.memberLock.Lock()
+	if group.members[address] == 0 {
+		group.memberLock.Unlock()
+		return
+	}
+	policy := this.poolPolicyLocked(group)
+	need := policy.Min - len(group.addressConns(address)) - group.dialing[address]
+	for i := 0; i < need; i++ {
+		group.startDialLocked(address)
+	}
+	group.memberLock.Unlock()
+
+	for i := 0; i < need; i++ {
+		go this.dial(group, address)
+	}
+}
+
+//发送队列积压时给address增加一个连接
+func (this *TransPortClient) grow(group *ServerConnGroup, address string) {
+	group.memberLock.Lock()
+	if group.members[address] == 0 || group.dialing[address] > 0 {
+		group.memberLock.Unlock()
+		return
+	}
+	policy := this.poolPolicyLocked(group)
+	conns := group.addressConns(address)
+	if len(conns) == 0 || len(conns) >= policy.Max {
+		group.memberLock.Unlock()
+		return
+	}
+
+	queued := 0
+	for _, conn := range conns {
+		queued += conn.QueueLen()
+	}
+	if queued < policy.GrowQueueLen * len(conns) {
+		group.memberLock.Unlock()
+		return
+	}
+	group.startDialLocked(address)
+	group.memberLock.Unlock()
+
+	log.Println("ConnPool -> grow ", group.name, " ", address, " to ", len(conns) + 1)
+	go this.dial(group, address)
+}
+
+//关闭一个超过Min并且空闲的连接
+func (this *TransPortClient) shrink(group *ServerConnGroup, address string) {
+	group.memberLock.Lock()
+	policy := this.poolPolicyLocked(group)
+	group.memberLock.Unlock()
+
+	conns := group.addressConns(address)
+	if len(conns) <= policy.Min {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	for _, conn := range conns {
+		last := atomic.LoadInt64(&conn.lastWrite)
+		if last == 0 {
+			//还没有发送过数据，从第一次检查开始计算空闲时间
+			atomic.CompareAndSwapInt64(&conn.lastWrite, 0, now)
+			continue
+		}
+		if now - last < int64(policy.IdleTimeout) || conn.QueueLen() > 0 || conn.PendingCalls() > 0 {
+			continue
+		}
+
+		log.Println("ConnPool -> shrink ", group.name, " ", conn.String(), " to ", len(conns) - 1)
+		conn.Reconnect = false
+		conn.startDrain()
+		go conn.Drain(this.DrainTimeout)
+		return
+	}
+}
+
+func (this *TransPortClient) poolLoop() {
+	defer RecoverPrint()
+
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-time.After(poolCheckInterval):
+		}
+
+		this.lock.RLock()
+		groups := append([]*ServerConnGroup(nil), this.connGroups...)
+		this.lock.RUnlock()
+
+		for _, group := range groups {
+			for _, address := range group.Members() {
+				this.fill(group, address)
+				this.grow(group, address)
+				this.shrink(group, address)
+			}
+		}
+	}
+}
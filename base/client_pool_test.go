@@ -0,0 +1,71 @@
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sotter/dovenet/protocol"
+)
+
+func TestFixPoolPolicy(t *testing.T) {
+	client := NewTransPortClient()
+	client.ChanSize = 100
+
+	tests := []struct {
+		name   string
+		policy PoolPolicy
+		want   PoolPolicy
+	}{
+		{"defaults", PoolPolicy{}, PoolPolicy{Min: 1, Max: 1, GrowQueueLen: 51, IdleTimeout: 60 * time.Second}},
+		{"max below min", PoolPolicy{Min: 3, Max: 2}, PoolPolicy{Min: 3, Max: 3, GrowQueueLen: 51, IdleTimeout: 60 * time.Second}},
+		{"kept", PoolPolicy{Min: 2, Max: 4, GrowQueueLen: 8, IdleTimeout: time.Second},
+			PoolPolicy{Min: 2, Max: 4, GrowQueueLen: 8, IdleTimeout: time.Second}},
+	}
+
+	for _, test := range tests {
+		if got := client.fixPoolPolicy(test.policy); got != test.want {
+			t.Errorf("%s: policy %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+//每次只排空一个超过Min并且空闲的连接，有积压或者刚发送过的连接保留
+func TestPoolShrink(t *testing.T) {
+	client := NewTransPortClient()
+	client.RegisterConnGroup("g")
+	group := client.group("g")
+	group.pool = &PoolPolicy{Min: 1, Max: 4, IdleTimeout: time.Minute}
+
+	old := time.Now().Add(-time.Hour).UnixNano()
+	recent := newManagedConn(group.Manager, 1, "a:1")
+	recent.lastWrite = time.Now().UnixNano()
+	queued := newManagedConn(group.Manager, 2, "a:1")
+	queued.lastWrite = old
+	queued.TryWrite(protocol.NewCommMsg(1, nil))
+	fresh := newManagedConn(group.Manager, 3, "a:1")
+
+	//没有空闲的连接，还没有发送过数据的连接从这次检查开始计算空闲时间
+	client.shrink(group, "a:1")
+	if recent.IsDraining() || queued.IsDraining() || fresh.IsDraining() {
+		t.Fatal("busy conn drained")
+	}
+	if fresh.lastWrite == 0 {
+		t.Errorf("never-written conn not stamped for idle tracking")
+	}
+
+	idle := newManagedConn(group.Manager, 4, "a:1")
+	idle.lastWrite = old
+	idle2 := newManagedConn(group.Manager, 5, "a:1")
+	idle2.lastWrite = old
+
+	client.shrink(group, "a:1")
+	drained := 0
+	for _, conn := range []*TcpConnection{recent, queued, fresh, idle, idle2} {
+		if conn.IsDraining() {
+			drained++
+		}
+	}
+	if drained != 1 || !(idle.IsDraining() || idle2.IsDraining()) {
+		t.Errorf("%d conns draining after shrink, want one of the idle ones", drained)
+	}
+}
@@ -0,0 +1,95 @@
+package base
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"github.com/sotter/dovenet/protocol"
+)
+
+var (
+	tcpConnectionType = reflect.TypeOf((*TcpConnection)(nil))
+	errorType         = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+//按MsgType分发的NetworkCallBack，handler调用之前先按注册的类型把包体解码好
+//没有注册handler的消息以及连接事件交给NetworkCB处理
+type TypedDispatcher struct {
+	Registry  *protocol.TypeRegistry
+	NetworkCB NetworkCallBack
+
+	lock     sync.RWMutex
+	handlers map[uint16]reflect.Value
+}
+
+func NewTypedDispatcher(registry *protocol.TypeRegistry, networkcb NetworkCallBack) *TypedDispatcher {
+	if registry == nil {
+		registry = protocol.DefaultRegistry
+	}
+
+	return &TypedDispatcher{
+		Registry:  registry,
+		NetworkCB: networkcb,
+		handlers:  make(map[uint16]reflect.Value),
+	}
+}
+
+//注册handler，格式为 func(conn *TcpConnection, req *T) error，T必须已经在Registry中注册
+func (this *TypedDispatcher) Handle(handler interface{}) error {
+	fn := reflect.ValueOf(handler)
+	ft := fn.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 2 || ft.NumOut() != 1 ||
+		ft.In(0) != tcpConnectionType || ft.In(1).Kind() != reflect.Ptr || ft.Out(0) != errorType {
+		return fmt.Errorf("Handle : handler must be func(*TcpConnection, *T) error, got %v", ft)
+	}
+
+	msgType, exist := this.Registry.MsgType(ft.In(1))
+	if !exist {
+		return fmt.Errorf("Handle : %v is not registered", ft.In(1))
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, exist := this.handlers[msgType]; exist {
+		return fmt.Errorf("Handle : MsgType %d already has a handler", msgType)
+	}
+	this.handlers[msgType] = fn
+	return nil
+}
+
+func (this *TypedDispatcher) OnMessageData(conn *TcpConnection, msg protocol.Message) error {
+	if cm, ok := msg.(*protocol.CommMsg); ok {
+		this.lock.RLock()
+		fn, exist := this.handlers[cm.Header.MsgType]
+		this.lock.RUnlock()
+
+		if exist {
+			v, err := this.Registry.Decode(cm)
+			if err != nil {
+				return err
+			}
+			out := fn.Call([]reflect.Value{reflect.ValueOf(conn), reflect.ValueOf(v)})
+			if err, _ := out[0].Interface().(error); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
+	if this.NetworkCB != nil {
+		return this.NetworkCB.OnMessageData(conn, msg)
+	}
+	return nil
+}
+
+func (this *TypedDispatcher) OnConnection(conn *TcpConnection) {
+	if this.NetworkCB != nil {
+		this.NetworkCB.OnConnection(conn)
+	}
+}
+
+func (this *TypedDispatcher) OnDisConnection(conn *TcpConnection) {
+	if this.NetworkCB != nil {
+		this.NetworkCB.OnDisConnection(conn)
+	}
+}
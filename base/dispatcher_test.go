@@ -0,0 +1,88 @@
+package base
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sotter/dovenet/protocol"
+)
+
+type echoReq struct {
+	Text string
+}
+
+type unknownReq struct{}
+
+//记录交给NetworkCB的消息
+type recordCallBack struct {
+	nopCallBack
+	msgs []protocol.Message
+}
+
+func (this *recordCallBack) OnMessageData(conn *TcpConnection, msg protocol.Message) error {
+	this.msgs = append(this.msgs, msg)
+	return nil
+}
+
+func TestTypedDispatcherHandle(t *testing.T) {
+	registry := protocol.NewTypeRegistry(nil)
+	registry.Register(1, echoReq{})
+	dispatcher := NewTypedDispatcher(registry, nil)
+
+	tests := []struct {
+		name    string
+		handler interface{}
+		ok      bool
+	}{
+		{"not a func", 1, false},
+		{"wrong args", func(conn *TcpConnection) error { return nil }, false},
+		{"value arg", func(conn *TcpConnection, req echoReq) error { return nil }, false},
+		{"no error", func(conn *TcpConnection, req *echoReq) {}, false},
+		{"unregistered", func(conn *TcpConnection, req *unknownReq) error { return nil }, false},
+		{"ok", func(conn *TcpConnection, req *echoReq) error { return nil }, true},
+		{"duplicate", func(conn *TcpConnection, req *echoReq) error { return nil }, false},
+	}
+	for _, test := range tests {
+		if err := dispatcher.Handle(test.handler); (err == nil) != test.ok {
+			t.Errorf("%s: err = %v", test.name, err)
+		}
+	}
+}
+
+func TestTypedDispatcherDispatch(t *testing.T) {
+	registry := protocol.NewTypeRegistry(nil)
+	registry.Register(1, echoReq{})
+	fallback := &recordCallBack{}
+	dispatcher := NewTypedDispatcher(registry, fallback)
+
+	failed := errors.New("failed")
+	var got string
+	dispatcher.Handle(func(conn *TcpConnection, req *echoReq) error {
+		got = req.Text
+		if req.Text == "fail" {
+			return failed
+		}
+		return nil
+	})
+
+	for _, text := range []string{"hello", "fail"} {
+		msg, _ := registry.Encode(&echoReq{Text: text})
+		err := dispatcher.OnMessageData(nil, msg)
+		if got != text {
+			t.Errorf("handler got %q, want %q", got, text)
+		}
+		if text == "fail" && err != failed {
+			t.Errorf("err = %v, want the handler error", err)
+		}
+	}
+
+	//包体解码失败时返回错误，没有handler的消息交给NetworkCB
+	if err := dispatcher.OnMessageData(nil, protocol.NewCommMsg(1, []byte("{"))); err == nil {
+		t.Errorf("bad body dispatched")
+	}
+	other := protocol.NewCommMsg(2, nil)
+	dispatcher.OnMessageData(nil, other)
+	if len(fallback.msgs) != 1 || fallback.msgs[0] != other {
+		t.Errorf("NetworkCB got %v, want the unhandled message", fallback.msgs)
+	}
+}
@@ -0,0 +1,212 @@
+package base
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/sotter/dovenet/protocol"
+	log "github.com/sotter/dovenet/log"
+)
+
+//转发规则：MsgType在[MinType, MaxType]之间的消息转发到Group对应的后端
+//  Affinity : 同一个客户端连接的消息固定转发到同一个后端连接，后端连接断开后重新选择
+//  Timeout  : 等待后端回应的时间，超时给客户端回一个错误；为0时单向转发，不关心回应
+type GatewayRule struct {
+	MinType  uint16
+	MaxType  uint16
+	Group    string
+	Affinity bool
+	Timeout  time.Duration
+}
+
+type GatewayStats struct {
+	Forwarded uint64 // 转发给后端的消息数
+	Replied   uint64 // 回给客户端的后端回应数
+	Timeouts  uint64 // 等待后端回应超时的次数
+	NoBackend uint64 // 没有可用的后端连接的次数
+}
+
+//网关：TCPServer接入的客户端消息按MsgType转发给TransPortClient中的一组后端服务，
+//后端的回应按请求来源回给对应的客户端连接。
+//转发需要回应时依赖v2头部的Seq，后端连接的CommProtocol.Version要设置为2并打开V2First，后端用protocol.NewReplyMsg回应，
+//否则转发时给客户端回ErrorNoSeq的错误。转发和TransPortClient的请求一样计入发送限制、熔断和健康检查
+type Gateway struct {
+	Client    *TransPortClient
+	NetworkCB NetworkCallBack // 没有匹配规则的消息以及客户端的连接事件
+
+	lock     sync.RWMutex
+	rules    []GatewayRule
+	affinity map[uint64]map[string]*TcpConnection // 客户端ConnID -> Group -> 后端连接
+
+	stats GatewayStats
+}
+
+func NewGateway(client *TransPortClient, networkcb NetworkCallBack) *Gateway {
+	return &Gateway{
+		Client:    client,
+		NetworkCB: networkcb,
+		affinity:  make(map[uint64]map[string]*TcpConnection),
+	}
+}
+
+//按添加的顺序匹配，先添加的优先
+func (this *Gateway) AddRule(rule GatewayRule) error {
+	if rule.Group == "" || rule.MinType > rule.MaxType {
+		return fmt.Errorf("Gateway AddRule : invalid rule %+v", rule)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.rules = append(this.rules, rule)
+	return nil
+}
+
+func (this *Gateway) Route(msgType uint16) (GatewayRule, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	for _, rule := range this.rules {
+		if msgType >= rule.MinType && msgType <= rule.MaxType {
+			return rule, true
+		}
+	}
+	return GatewayRule{}, false
+}
+
+//选择后端连接，需要亲和性时优先使用之前绑定的连接
+func (this *Gateway) pickBackend(conn *TcpConnection, rule *GatewayRule) *TcpConnection {
+	if rule.Affinity {
+		this.lock.RLock()
+		backend := this.affinity[conn.ConnID][rule.Group]
+		this.lock.RUnlock()
+		//绑定的连接被摘除、熔断或者正在排空时重新选择
+		if backend != nil && backend.Available() {
+			return backend
+		}
+	}
+
+	manager := this.Client.groupManager(rule.Group)
+	if manager == nil {
+		return nil
+	}
+	backend := manager.GetRotationSession()
+	if backend == nil || !rule.Affinity {
+		return backend
+	}
+
+	//客户端已经断开的不再记录
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if conn.IsClosed() {
+		return backend
+	}
+	groups, exist := this.affinity[conn.ConnID]
+	if !exist {
+		groups = make(map[string]*TcpConnection)
+		this.affinity[conn.ConnID] = groups
+	}
+	groups[rule.Group] = backend
+	return backend
+}
+
+//把后端的回应还原成客户端请求的Seq，回给客户端
+//带FlagError的后端回应原样转发
+func (this *Gateway) replyToClient(conn *TcpConnection, req *protocol.CommMsg, reply *protocol.CommMsg, err error) {
+	if reply == nil {
+		if err == ErrorTimeout {
+			atomic.AddUint64(&this.stats.Timeouts, 1)
+		}
+		conn.TryWrite(protocol.NewErrorReply(req, "gateway : " + err.Error()))
+		return
+	}
+
+	resp := &protocol.CommMsg{
+		Header: reply.Header,
+		Body:   reply.Body,
+	}
+	resp.Header.Seq = req.Header.Seq
+	if conn.TryWrite(resp) == DELIVERY_SENT {
+		atomic.AddUint64(&this.stats.Replied, 1)
+	}
+}
+
+//转发一个客户端消息，没有匹配的规则时返回false
+func (this *Gateway) Forward(conn *TcpConnection, req *protocol.CommMsg) (bool, error) {
+	rule, exist := this.Route(req.Header.MsgType)
+	if !exist {
+		return false, nil
+	}
+
+	release, err := this.Client.acquireLimit(rule.Group)
+	if err != nil {
+		if rule.Timeout > 0 {
+			this.replyToClient(conn, req, nil, err)
+		}
+		return true, err
+	}
+
+	backend := this.pickBackend(conn, &rule)
+	if backend == nil {
+		release()
+		atomic.AddUint64(&this.stats.NoBackend, 1)
+		log.Println("Gateway -> no backend for ", rule.Group, " MsgType ", req.Header.MsgType)
+		if rule.Timeout > 0 {
+			this.replyToClient(conn, req, nil, ErrorNoConnection)
+		}
+		return true, ErrorNoConnection
+	}
+
+	atomic.AddUint64(&this.stats.Forwarded, 1)
+	if rule.Timeout <= 0 {
+		status, err := this.Client.sendOnce(backend, &trackedMsg{Message: req, done: release}, false)
+		if status != DELIVERY_SENT {
+			release()
+		}
+		return true, err
+	}
+
+	this.Client.callAsync(backend, req, rule.Timeout, func(reply *protocol.CommMsg, sent bool, err error) {
+		release()
+		this.replyToClient(conn, req, reply, err)
+	})
+	return true, nil
+}
+
+func (this *Gateway) Stats() GatewayStats {
+	return GatewayStats{
+		Forwarded: atomic.LoadUint64(&this.stats.Forwarded),
+		Replied:   atomic.LoadUint64(&this.stats.Replied),
+		Timeouts:  atomic.LoadUint64(&this.stats.Timeouts),
+		NoBackend: atomic.LoadUint64(&this.stats.NoBackend),
+	}
+}
+
+func (this *Gateway) OnMessageData(conn *TcpConnection, msg protocol.Message) error {
+	if cm, ok := msg.(*protocol.CommMsg); ok {
+		if handled, err := this.Forward(conn, cm); handled {
+			return err
+		}
+	}
+
+	if this.NetworkCB != nil {
+		return this.NetworkCB.OnMessageData(conn, msg)
+	}
+	return nil
+}
+
+func (this *Gateway) OnConnection(conn *TcpConnection) {
+	if this.NetworkCB != nil {
+		this.NetworkCB.OnConnection(conn)
+	}
+}
+
+func (this *Gateway) OnDisConnection(conn *TcpConnection) {
+	this.lock.Lock()
+	delete(this.affinity, conn.ConnID)
+	this.lock.Unlock()
+
+	if this.NetworkCB != nil {
+		this.NetworkCB.OnDisConnection(conn)
+	}
+}
@@ -0,0 +1,58 @@
+package base
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sotter/dovenet/protocol"
+)
+
+//绑定的后端连接不可用（被摘除）时重新选择
+func TestGatewayAffinityAvailable(t *testing.T) {
+	client := NewTransPortClient()
+	newTestGroup(client, "g", []string{"a:1", "b:1"}, 1)
+	gateway := NewGateway(client, nil)
+	rule := &GatewayRule{MinType: 1, MaxType: 1, Group: "g", Affinity: true}
+	conn := NewClientConn(100, nil, 1, nopCallBack{})
+
+	first := gateway.pickBackend(conn, rule)
+	if first == nil {
+		t.Fatal("no backend")
+	}
+	for i := 0; i < 3; i++ {
+		if backend := gateway.pickBackend(conn, rule); backend != first {
+			t.Fatalf("pick %d: backend %v, want %v", i, backend, first)
+		}
+	}
+
+	atomic.StoreInt64(&first.health.ejectedUntil, time.Now().Add(time.Minute).UnixNano())
+	second := gateway.pickBackend(conn, rule)
+	if second == nil || second == first {
+		t.Fatalf("backend after eject = %v, want another one", second)
+	}
+	if backend := gateway.pickBackend(conn, rule); backend != second {
+		t.Errorf("affinity not moved to %v, got %v", second, backend)
+	}
+}
+
+//转发和TransPortClient的请求一样受发送限制
+func TestGatewayForwardLimit(t *testing.T) {
+	client := NewTransPortClient()
+	newTestGroup(client, "g", []string{"a:1"}, 1)
+	client.SetLimitPolicy("g", &LimitPolicy{MaxInFlight: 1, Mode: LIMIT_FAIL_FAST})
+	gateway := NewGateway(client, nil)
+	gateway.AddRule(GatewayRule{MinType: 1, MaxType: 1, Group: "g"})
+	conn := NewClientConn(100, nil, 1, nopCallBack{})
+
+	//后端连接没有启动，第一个消息一直留在发送队列中，占着进行中的名额
+	if handled, err := gateway.Forward(conn, protocol.NewCommMsg(1, nil)); !handled || err != nil {
+		t.Fatalf("forward = %v, %v", handled, err)
+	}
+	if _, err := gateway.Forward(conn, protocol.NewCommMsg(1, nil)); err != ErrorRateLimited {
+		t.Errorf("second forward err = %v, want ErrorRateLimited", err)
+	}
+	if handled, _ := gateway.Forward(conn, protocol.NewCommMsg(2, nil)); handled {
+		t.Errorf("message without rule forwarded")
+	}
+}
@@ -0,0 +1,210 @@
+package base
+
+import (
+	"sync/atomic"
+	"time"
+	log "github.com/sotter/dovenet/log"
+)
+
+//后端连接的健康检查和摘除策略，对TransPortClient中的所有ServerConnGroup生效
+//  - 连续失败MaxFailures次（发送队列满、请求超时、心跳超时、RTT过高）后摘除EjectDuration，之后自动恢复
+//  - 一个组中被摘除的连接最多占MaxEjectPercent（向上取整），组内全部不可用时仍然会选择被摘除的连接
+type HealthPolicy struct {
+	MaxFailures      int
+	EjectDuration    time.Duration
+	MaxEjectPercent  int
+
+	CheckInterval    time.Duration // 主动检查的间隔
+	PingInterval     time.Duration // 主动检查时发送心跳的间隔
+	HeartBeatTimeout time.Duration // 心跳发出后超过这个时间没有回应算一次失败
+	MaxRTT           time.Duration // 心跳RTT超过这个值算一次失败，为0时不检查
+}
+
+func DefaultHealthPolicy() HealthPolicy {
+	return HealthPolicy{
+		MaxFailures:      5,
+		EjectDuration:    30 * time.Second,
+		MaxEjectPercent:  50,
+		CheckInterval:    time.Second,
+		PingInterval:     5 * time.Second,
+		HeartBeatTimeout: 10 * time.Second,
+	}
+}
+
+//连接上的健康状态，都用atomic访问
+type connHealth struct {
+	failures     int32
+	ejectedUntil int64 // UnixNano
+	checkedPong  int64 // 已经检查过RTT的心跳回应时间
+}
+
+//被摘除的连接不会被选中，到期后自动恢复
+func (this *TcpConnection) Ejected() bool {
+	until := atomic.LoadInt64(&this.health.ejectedUntil)
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+//连续失败的次数
+func (this *TcpConnection) Failures() int {
+	return int(atomic.LoadInt32(&this.health.failures))
+}
+
+func (this *TcpConnection) recordSuccess() {
+	atomic.StoreInt32(&this.health.failures, 0)
+}
+
+func (this *TcpConnection) recordFailure() int {
+	return int(atomic.AddInt32(&this.health.failures, 1))
+}
+
+//开启健康检查，定时给组内的连接发心跳并检查超时和RTT
+func (this *TransPortClient) EnableHealthCheck(policy HealthPolicy) {
+	defaults := DefaultHealthPolicy()
+	if policy.MaxFailures <= 0 {
+		policy.MaxFailures = defaults.MaxFailures
+	}
+	if policy.EjectDuration <= 0 {
+		policy.EjectDuration = defaults.EjectDuration
+	}
+	if policy.MaxEjectPercent <= 0 {
+		policy.MaxEjectPercent = defaults.MaxEjectPercent
+	}
+	if policy.CheckInterval <= 0 {
+		policy.CheckInterval = defaults.CheckInterval
+	}
+	if policy.PingInterval <= 0 {
+		policy.PingInterval = defaults.PingInterval
+	}
+	if policy.HeartBeatTimeout <= 0 {
+		policy.HeartBeatTimeout = defaults.HeartBeatTimeout
+	}
+
+	this.lock.Lock()
+	started := this.health != nil
+	this.health = &policy
+	this.lock.Unlock()
+
+	if !started {
+		go this.healthLoop()
+	}
+}
+
+func (this *TransPortClient) healthPolicy() *HealthPolicy {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.health
+}
+
+//请求成功（包括收到错误回应，说明对端是活的），计入健康检查和熔断
+func (this *TransPortClient) reportSuccess(conn *TcpConnection) {
+	this.breakerDone(conn, true)
+	this.healthSuccess(conn)
+}
+
+//请求失败，计入健康检查和熔断
+func (this *TransPortClient) reportFailure(conn *TcpConnection) {
+	this.breakerDone(conn, false)
+	this.healthFailure(conn)
+}
+
+//心跳的结果只计入健康检查，熔断只统计真实的请求
+func (this *TransPortClient) healthSuccess(conn *TcpConnection) {
+	conn.recordSuccess()
+}
+
+//连续失败达到上限时摘除
+func (this *TransPortClient) healthFailure(conn *TcpConnection) {
+	failures := conn.recordFailure()
+
+	policy := this.healthPolicy()
+	if policy == nil || failures < policy.MaxFailures || conn.Ejected() {
+		return
+	}
+	this.eject(conn, policy)
+}
+
+func (this *TransPortClient) eject(conn *TcpConnection, policy *HealthPolicy) {
+	manager := conn.ConnManager
+	if manager == nil {
+		return
+	}
+
+	//保证一个组中不会摘除太多，按向上取整计算，只有一个连接的组也可以摘除
+	total, ejected := 0, 0
+	manager.BroadcastRun(func(c *TcpConnection) {
+		total++
+		if c.Ejected() {
+			ejected++
+		}
+	})
+	if (ejected + 1) * 100 > total * policy.MaxEjectPercent + 99 {
+		log.Println("HealthCheck -> too many ejected in ", conn.Name, ", keep ", conn.String())
+		return
+	}
+
+	atomic.StoreInt64(&conn.health.ejectedUntil, time.Now().Add(policy.EjectDuration).UnixNano())
+	log.Println("HealthCheck -> eject ", conn.Name, " ", conn.String(), " failures ", conn.Failures())
+}
+
+func (this *TransPortClient) healthLoop() {
+	defer RecoverPrint()
+
+	for {
+		policy := this.healthPolicy()
+		select {
+		case <-this.stop:
+			return
+		case <-time.After(policy.CheckInterval):
+		}
+
+		this.lock.RLock()
+		groups := append([]*ServerConnGroup(nil), this.connGroups...)
+		this.lock.RUnlock()
+
+		for _, group := range groups {
+			for _, conn := range group.Manager.Sessions() {
+				this.checkConn(conn, policy)
+			}
+		}
+	}
+}
+
+func (this *TransPortClient) checkConn(conn *TcpConnection, policy *HealthPolicy) {
+	if conn.IsClosed() {
+		return
+	}
+	now := time.Now()
+
+	//摘除到期，恢复并重新计数
+	until := atomic.LoadInt64(&conn.health.ejectedUntil)
+	if until != 0 && now.UnixNano() >= until {
+		if atomic.CompareAndSwapInt64(&conn.health.ejectedUntil, until, 0) {
+			conn.recordSuccess()
+			log.Println("HealthCheck -> reinstate ", conn.Name, " ", conn.String())
+		}
+	}
+
+	ping := atomic.LoadInt64(&conn.pingTime)
+	//心跳超时算一次失败，清掉这个心跳请求，下面重新发一个，对端一直没有回应时每个HeartBeatTimeout都会计数
+	if ping != 0 && now.UnixNano() - ping > int64(policy.HeartBeatTimeout) &&
+		atomic.CompareAndSwapInt64(&conn.pingTime, ping, 0) {
+		log.Println("HealthCheck -> heartbeat timeout ", conn.String())
+		this.healthFailure(conn)
+		ping = 0
+	}
+
+	pong := atomic.LoadInt64(&conn.pongTime)
+	if pong != 0 && atomic.SwapInt64(&conn.health.checkedPong, pong) != pong {
+		if policy.MaxRTT > 0 && conn.RTT() > policy.MaxRTT {
+			log.Println("HealthCheck -> rtt ", conn.RTT(), " too high ", conn.String())
+			this.healthFailure(conn)
+		} else {
+			this.healthSuccess(conn)
+		}
+	}
+
+	//没有未回应的心跳并且距离上次回应超过PingInterval时，主动发一次心跳
+	if ping == 0 && now.UnixNano() - pong >= int64(policy.PingInterval) {
+		conn.DoHeartBeat()
+	}
+}
@@ -0,0 +1,82 @@
+package base
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sotter/dovenet/protocol"
+)
+
+func newHealthConn(client *TransPortClient, id uint64, address string) *TcpConnection {
+	conn := NewClientConn(id, protocol.NewCommCodec(nil, nil), 16, nopCallBack{})
+	conn.Name = "g"
+	conn.Address = address
+	client.RegisterConnServer(conn)
+	return conn
+}
+
+//对端一直不回应时，每个HeartBeatTimeout都重新发心跳并计一次失败，直到摘除
+func TestHealthHeartBeatTimeout(t *testing.T) {
+	policy := &HealthPolicy{MaxFailures: 3, EjectDuration: time.Minute, MaxEjectPercent: 50,
+		PingInterval: time.Millisecond, HeartBeatTimeout: time.Millisecond}
+	client := NewTransPortClient()
+	client.health = policy
+	conn := newHealthConn(client, 1, "a:1")
+
+	for i := 1; i <= policy.MaxFailures; i++ {
+		client.checkConn(conn, policy)
+		if atomic.LoadInt64(&conn.pingTime) == 0 {
+			t.Fatalf("check %d: no heartbeat pending", i)
+		}
+		time.Sleep(2 * policy.HeartBeatTimeout)
+		client.checkConn(conn, policy)
+		if conn.Failures() != i {
+			t.Fatalf("check %d: failures = %d", i, conn.Failures())
+		}
+	}
+	if !conn.Ejected() {
+		t.Errorf("conn not ejected after %d timeouts", policy.MaxFailures)
+	}
+	//每次超时后都重新发了心跳
+	if conn.QueueLen() != policy.MaxFailures + 1 {
+		t.Errorf("heartbeats sent = %d, want %d", conn.QueueLen(), policy.MaxFailures + 1)
+	}
+}
+
+func TestHealthMaxEjectPercent(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   int
+		percent int
+		want    int
+	}{
+		{"single conn", 1, 50, 1},
+		{"two conns", 2, 50, 1},
+		{"three conns", 3, 50, 2},
+		{"four conns", 4, 50, 2},
+		{"ten percent of five", 5, 10, 1},
+		{"all", 3, 100, 3},
+	}
+
+	for _, test := range tests {
+		policy := &HealthPolicy{MaxFailures: 1, EjectDuration: time.Minute, MaxEjectPercent: test.percent}
+		client := NewTransPortClient()
+		client.health = policy
+		var conns []*TcpConnection
+		for i := 0; i < test.total; i++ {
+			conns = append(conns, newHealthConn(client, uint64(i + 1), "a:1"))
+		}
+
+		ejected := 0
+		for _, conn := range conns {
+			client.healthFailure(conn)
+			if conn.Ejected() {
+				ejected++
+			}
+		}
+		if ejected != test.want {
+			t.Errorf("%s: ejected %d, want %d", test.name, ejected, test.want)
+		}
+	}
+}
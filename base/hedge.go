@@ -0,0 +1,177 @@
+package base
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/sotter/dovenet/protocol"
+)
+
+//对冲请求：第一个请求发出Delay后还没有回应，再发一个相同的请求给组内另一个节点（地址），取先到的回应
+//  - Percentile大于0并且统计的样本足够时，用组内最近Call耗时的分位数（如0.95）作为Delay
+//  - Delay为0并且没有分位数可用时使用timeout的一半
+//  - 同一个请求会被处理多次，只能用于幂等的请求
+type HedgePolicy struct {
+	Delay      time.Duration
+	Percentile float64
+	MaxHedges  int // 最多额外发出的请求数，默认1
+}
+
+//对冲的统计
+type HedgeStats struct {
+	Hedged uint64 // 额外发出的请求数
+	Wins   uint64 // 额外发出的请求先回应的次数
+}
+
+//最近Call耗时的环形缓冲，用于计算分位数
+const latencySamples = 256
+const minLatencySamples = 20
+
+type latencyWindow struct {
+	lock    sync.Mutex
+	samples [latencySamples]time.Duration
+	count   int
+	next    int
+}
+
+func (this *latencyWindow) add(d time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.samples[this.next] = d
+	this.next = (this.next + 1) % latencySamples
+	if this.count < latencySamples {
+		this.count++
+	}
+}
+
+//样本不够时返回false
+func (this *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	this.lock.Lock()
+	if this.count < minLatencySamples {
+		this.lock.Unlock()
+		return 0, false
+	}
+	samples := append([]time.Duration(nil), this.samples[:this.count]...)
+	this.lock.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	index := int(p * float64(len(samples)))
+	if index >= len(samples) {
+		index = len(samples) - 1
+	}
+	return samples[index], true
+}
+
+//记录成功的Call的耗时
+func (this *TransPortClient) recordLatency(name string, d time.Duration) {
+	if group := this.group(name); group != nil {
+		group.latency.add(d)
+	}
+}
+
+func (this *TransPortClient) HedgeStats() HedgeStats {
+	return HedgeStats{
+		Hedged: atomic.LoadUint64(&this.hedgeStats.Hedged),
+		Wins:   atomic.LoadUint64(&this.hedgeStats.Wins),
+	}
+}
+
+func (this *TransPortClient) hedgeDelay(name string, timeout time.Duration, policy *HedgePolicy) time.Duration {
+	if policy.Percentile > 0 {
+		if group := this.group(name); group != nil {
+			if d, ok := group.latency.percentile(policy.Percentile); ok {
+				return d
+			}
+		}
+	}
+	if policy.Delay > 0 {
+		return policy.Delay
+	}
+	return timeout / 2
+}
+
+//对冲的Call，见HedgePolicy；先到的成功回应（包括错误回应）返回，其他的回应被忽略，
+//所有请求都失败时返回最后一个错误；timeout是每个请求的超时
+func (this *TransPortClient) CallHedged(name string, msg *protocol.CommMsg, timeout time.Duration,
+	policy HedgePolicy) (*protocol.CommMsg, error) {
+
+	if policy.MaxHedges <= 0 {
+		policy.MaxHedges = 1
+	}
+	manager := this.groupManager(name)
+	if manager == nil {
+		return nil, ErrorNoConnection
+	}
+
+	//对冲额外发出的请求不单独计入限制
+	release, err := this.acquireLimit(name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	type result struct {
+		reply *protocol.CommMsg
+		err   error
+		hedge bool
+	}
+	results := make(chan result, policy.MaxHedges + 1)
+	//按地址记录，对冲请求要发给另一个节点，而不是同一个节点的另一个连接
+	tried := make(map[string]bool)
+
+	launch := func(hedge bool) bool {
+		tcpConn := manager.GetRotationSessionExceptAddress(tried)
+		if tcpConn == nil {
+			return false
+		}
+		tried[tcpConn.Address] = true
+		if hedge {
+			atomic.AddUint64(&this.hedgeStats.Hedged, 1)
+		}
+		go func() {
+			reply, _, err := this.callOnce(tcpConn, msg, timeout)
+			results <- result{reply, err, hedge}
+		}()
+		return true
+	}
+
+	if !launch(false) {
+		return nil, this.noConnError(name)
+	}
+	outstanding, hedges := 1, 0
+
+	timer := time.NewTimer(this.hedgeDelay(name, timeout, &policy))
+	defer timer.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case res := <-results:
+			if _, remote := res.err.(*RemoteError); res.err == nil || remote {
+				if res.hedge {
+					atomic.AddUint64(&this.hedgeStats.Wins, 1)
+				}
+				return res.reply, res.err
+			}
+			lastErr = res.err
+			outstanding--
+
+			//失败了不用再等Delay，直接换一个节点
+			if hedges < policy.MaxHedges && launch(true) {
+				hedges++
+				outstanding++
+			}
+			if outstanding == 0 {
+				return nil, lastErr
+			}
+
+		case <-timer.C:
+			if hedges < policy.MaxHedges && launch(true) {
+				hedges++
+				outstanding++
+				timer.Reset(this.hedgeDelay(name, timeout, &policy))
+			}
+		}
+	}
+}
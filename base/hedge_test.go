@@ -0,0 +1,39 @@
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sotter/dovenet/protocol"
+)
+
+//对冲请求按地址排除，同一个地址的其他连接不会再被选中
+func TestHedgeExcludesAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		conns     int
+		maxHedges int
+		want      uint64 // 额外发出的请求数
+	}{
+		{"one address many conns", []string{"a:1"}, 3, 3, 0},
+		{"two addresses", []string{"a:1", "b:1"}, 2, 3, 1},
+		{"limited by MaxHedges", []string{"a:1", "b:1", "c:1"}, 1, 1, 1},
+		{"all addresses", []string{"a:1", "b:1", "c:1"}, 2, 5, 2},
+	}
+
+	for _, test := range tests {
+		client := NewTransPortClient()
+		newTestGroup(client, "g", test.addresses, test.conns)
+
+		//连接没有启动，只能发v1头部，每个请求都立即失败，对冲请求不等Delay直接换下一个地址
+		_, err := client.CallHedged("g", protocol.NewCommMsg(1, nil), time.Second,
+			HedgePolicy{Delay: time.Minute, MaxHedges: test.maxHedges})
+		if err != ErrorNoSeq {
+			t.Errorf("%s: err = %v, want ErrorNoSeq", test.name, err)
+		}
+		if stats := client.HedgeStats(); stats.Hedged != test.want || stats.Wins != 0 {
+			t.Errorf("%s: stats %+v, want %d hedged", test.name, stats, test.want)
+		}
+	}
+}
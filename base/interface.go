@@ -16,6 +16,11 @@ var (
 	ErrorIllegalData error = errors.New("More than 8M data")
 	ErrorNotImplemented error = errors.New("Not implemented")
 	ErrorConnClosed error = errors.New("Connection closed")
+	ErrorTimeout error = errors.New("Timeout")
+	ErrorNoConnection error = errors.New("No Tcpconnecion can use.")
+	ErrorCircuitOpen error = errors.New("Circuit breaker is open")
+	ErrorRateLimited error = errors.New("Rate limited")
+	ErrorNoSeq error = errors.New("Connection can not carry request seq, v2 header required")
 )
 
 const (
@@ -51,3 +56,12 @@ type NetIOAction interface {
 	Close(connection *TcpConnection)
 }
 
+//对端返回的错误回应（带FlagError），见protocol.NewErrorReply
+type RemoteError struct {
+	MsgType uint16
+	Message string
+}
+
+func (this *RemoteError) Error() string {
+	return fmt.Sprintf("Remote error, msgtype %d : %s", this.MsgType, this.Message)
+}
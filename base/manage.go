@@ -2,9 +2,12 @@ package base
 //主要用于由Server派生的TcpConnection的管理
 
 import (
+	"sort"
 	"sync"
+	"sync/atomic"
 	"math/rand"
 	"time"
+	"github.com/sotter/dovenet/protocol"
 )
 
 //把一个大的Map，分成好多小的map管理，这样就减少了锁的粒度
@@ -17,6 +20,11 @@ type Manager struct {
 	disposeWait sync.WaitGroup
 
 	current     uint64
+
+	//标签、分组和对端地址的二级索引，见session_index.go
+	tags        *sessionIndex
+	groups      *sessionIndex
+	addresses   *sessionIndex
 }
 
 type sessionMap struct {
@@ -27,7 +35,9 @@ type sessionMap struct {
 func (this *sessionMap) RandomSelectFromMap() *TcpConnection {
 	var array_conns []*TcpConnection
 	for _, session := range this.sessions {
-		array_conns = append(array_conns, session)
+		if session.Available() {
+			array_conns = append(array_conns, session)
+		}
 	}
 
 	if len(array_conns) == 0 {
@@ -40,7 +50,11 @@ func (this *sessionMap) RandomSelectFromMap() *TcpConnection {
 }
 
 func NewManager() *Manager {
-	manager := &Manager{}
+	manager := &Manager{
+		tags:      newSessionIndex(),
+		groups:    newSessionIndex(),
+		addresses: newSessionIndex(),
+	}
 	for i := 0; i < len(manager.sessionMaps); i++ {
 		manager.sessionMaps[i].sessions = make(map[uint64]*TcpConnection)
 	}
@@ -77,33 +91,84 @@ func (this *Manager) GetSession(sessionID uint64) *TcpConnection {
 	return session
 }
 
-// 查找所有远端为address客户端
+// 查找所有远端为address客户端，按PutSession时的Address索引
 func (this *Manager) GetSessionByAddress(address string)  (conns []*TcpConnection) {
-	this.BroadcastRun(func (conn *TcpConnection) {
-		if conn.Address == address {
-			conns = append(conns, conn)
+	return this.addresses.get(address)
+}
+
+//可以被选中发送消息的连接，排除掉正在排空、被摘除和熔断中的；
+//全部被摘除时退而使用被摘除的连接，总比没有连接可用好，熔断中的不会使用
+func (this *Manager) availableSessions() []*TcpConnection {
+	var all_conns []*TcpConnection
+	var ejected_conns []*TcpConnection
+
+	this.BroadcastRun(func (conn *TcpConnection){
+		if conn.Available() {
+			all_conns = append(all_conns, conn)
+		} else if !conn.IsClosed() && !conn.IsDraining() && conn.breakerAllowing() {
+			ejected_conns = append(ejected_conns, conn)
 		}
 	})
 
-	return conns
+	if len(all_conns) == 0 {
+		return ejected_conns
+	}
+	return all_conns
 }
 
 //通过轮训的方式找到hash
 func (this *Manager) GetRotationSession() *TcpConnection {
-	var all_conns []*TcpConnection
+	return this.GetRotationSessionExcept(nil)
+}
 
-	this.BroadcastRun(func (conn *TcpConnection){
-		all_conns = append(all_conns, conn)
+//轮询选择，跳过exclude中的连接（按ConnID），用于重试时换一个连接
+//先按地址轮询，再选地址中负载（发送队列和未回应的请求）最小的连接，
+//这样一个地址有多个连接时，流量仍然按地址均匀分布
+func (this *Manager) GetRotationSessionExcept(exclude map[uint64]bool) *TcpConnection {
+	return this.rotation(func(conn *TcpConnection) bool {
+		return exclude[conn.ConnID]
 	})
+}
 
-	if len(all_conns) == 0 {
+//轮询选择，跳过exclude中的地址，用于对冲请求时换一个节点
+func (this *Manager) GetRotationSessionExceptAddress(exclude map[string]bool) *TcpConnection {
+	return this.rotation(func(conn *TcpConnection) bool {
+		return exclude[conn.Address]
+	})
+}
+
+func (this *Manager) rotation(skip func(conn *TcpConnection) bool) *TcpConnection {
+	byAddress := make(map[string][]*TcpConnection)
+	var addresses []string
+	for _, conn := range this.availableSessions() {
+		if skip(conn) {
+			continue
+		}
+		if _, exist := byAddress[conn.Address]; !exist {
+			addresses = append(addresses, conn.Address)
+		}
+		byAddress[conn.Address] = append(byAddress[conn.Address], conn)
+	}
+
+	if len(addresses) == 0 {
 		return nil
 	}
+	sort.Strings(addresses)
 
-	index := (this.current) % uint64(len(all_conns))
-	this.current++
+	index := (atomic.AddUint64(&this.current, 1) - 1) % uint64(len(addresses))
+	return leastLoaded(byAddress[addresses[index]])
+}
 
-	return all_conns[index]
+func leastLoaded(conns []*TcpConnection) *TcpConnection {
+	var best *TcpConnection
+	bestLoad := 0
+	for _, conn := range conns {
+		load := conn.QueueLen() + conn.PendingCalls()
+		if best == nil || load < bestLoad {
+			best, bestLoad = conn, load
+		}
+	}
+	return best
 }
 
 func (this *Manager) GetRandomSession() *TcpConnection {
@@ -133,11 +198,7 @@ func (this *Manager) GetRandomSession() *TcpConnection {
 
 //TODO 暂时先不实现
 func (this *Manager) GetHashSession(hashCode uint64) *TcpConnection {
-	var all_conns []*TcpConnection
-
-	this.BroadcastRun(func (conn *TcpConnection){
-		all_conns = append(all_conns, conn)
-	})
+	all_conns := this.availableSessions()
 
 	if len(all_conns) == 0 {
 		return nil
@@ -148,6 +209,20 @@ func (this *Manager) GetHashSession(hashCode uint64) *TcpConnection {
 	return all_conns[index]
 }
 
+//当前所有连接的快照，遍历时不持有锁
+func (this *Manager) Sessions() []*TcpConnection {
+	var conns []*TcpConnection
+	this.BroadcastRun(func(conn *TcpConnection) {
+		conns = append(conns, conn)
+	})
+	return conns
+}
+
+//把msg广播给所有（或者opt.Filter选中的）连接，只编码一次，投递时不持有Manager的锁
+func (this *Manager) Broadcast(msg protocol.Message, opt *BroadcastOption) []BroadcastResult {
+	return broadcast(this.Sessions(), msg, opt)
+}
+
 //全局Connection共同执行一个函数
 func (this *Manager) BroadcastRun(handler func(*TcpConnection)) {
 	for i := 0; i < sessionMapNum; i++ {
@@ -167,9 +242,14 @@ func (this *Manager) PutSession(session *TcpConnection) {
 	defer smap.Unlock()
 	smap.sessions[session.ConnID] = session
 	this.disposeWait.Add(1)
+	this.addresses.add(session.Address, session)
 }
 
 func (this *Manager) delSession(session *TcpConnection) {
+	this.tags.removeConn(session.ConnID)
+	this.groups.removeConn(session.ConnID)
+	this.addresses.removeConn(session.ConnID)
+
 	if this.disposeFlag {
 		this.disposeWait.Done()
 		return
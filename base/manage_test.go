@@ -0,0 +1,96 @@
+package base
+
+import (
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/sotter/dovenet/protocol"
+)
+
+func newManagedConn(manager *Manager, id uint64, address string) *TcpConnection {
+	c, _ := net.Pipe()
+	conn := NewClientConn(id, protocol.NewCommCodec(c, nil), 1, nopCallBack{})
+	conn.Address = address
+	conn.ConnManager = manager
+	manager.PutSession(conn)
+	return conn
+}
+
+func connIds(conns []*TcpConnection) []uint64 {
+	ids := make([]uint64, 0, len(conns))
+	for _, conn := range conns {
+		ids = append(ids, conn.ConnID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+func sameIds(got []uint64, want ...uint64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestManagerAddressIndex(t *testing.T) {
+	manager := NewManager()
+	a1 := newManagedConn(manager, 1, "a:1")
+	newManagedConn(manager, 2, "a:1")
+	newManagedConn(manager, 3, "b:1")
+
+	if ids := connIds(manager.GetSessionByAddress("a:1")); !sameIds(ids, 1, 2) {
+		t.Errorf("a:1 = %v, want [1 2]", ids)
+	}
+	if ids := connIds(manager.GetSessionByAddress("c:1")); !sameIds(ids) {
+		t.Errorf("c:1 = %v, want []", ids)
+	}
+
+	a1.Close()
+	if ids := connIds(manager.GetSessionByAddress("a:1")); !sameIds(ids, 2) {
+		t.Errorf("a:1 after close = %v, want [2]", ids)
+	}
+}
+
+//连接关闭时从标签和分组中删除
+func TestManagerIndexesOnClose(t *testing.T) {
+	manager := NewManager()
+	c1 := newManagedConn(manager, 1, "a:1")
+	c2 := newManagedConn(manager, 2, "b:1")
+
+	manager.Tag(c1, "uid:1")
+	manager.Tag(c2, "uid:1")
+	manager.Join("room", c1)
+	manager.Join("room", c2)
+	manager.Join("lobby", c1)
+
+	if ids := connIds(manager.GetSessionsByTag("uid:1")); !sameIds(ids, 1, 2) {
+		t.Errorf("tag = %v, want [1 2]", ids)
+	}
+	if groups := manager.Groups(c1); len(groups) != 2 {
+		t.Errorf("groups of c1 = %v", groups)
+	}
+
+	manager.Leave("lobby", c1)
+	if n := manager.GroupSize("lobby"); n != 0 {
+		t.Errorf("lobby size after leave = %d", n)
+	}
+
+	c1.Close()
+	if ids := connIds(manager.GetSessionsByTag("uid:1")); !sameIds(ids, 2) {
+		t.Errorf("tag after close = %v, want [2]", ids)
+	}
+	if ids := connIds(manager.GetGroupSessions("room")); !sameIds(ids, 2) {
+		t.Errorf("room after close = %v, want [2]", ids)
+	}
+	if err := manager.Tag(c1, "uid:2"); err == nil {
+		t.Errorf("tagged a closed connection")
+	}
+}
@@ -0,0 +1,414 @@
+package base
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	log "github.com/sotter/dovenet/log"
+)
+
+//PROXY protocol的处理方式
+const (
+	PROXY_OFF = iota  // 不解析
+	PROXY_OPTIONAL    // 有PROXY头部时解析，没有时按普通连接处理
+	PROXY_STRICT      // 必须有PROXY头部，否则关闭连接
+)
+
+var (
+	ErrorProxyHeader  error = errors.New("Invalid PROXY protocol header")
+	ErrorProxyMissing error = errors.New("Missing PROXY protocol header")
+	ErrorProxyTrusted error = errors.New("PROXY protocol requires trusted addresses")
+)
+
+//v2头部的固定前缀
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//v1头部最长107字节
+const proxyV1MaxLength = 107
+
+//Accept出错后重试的等待时间
+const (
+	proxyAcceptMinDelay = 5 * time.Millisecond
+	proxyAcceptMaxDelay = time.Second
+)
+
+//L4负载均衡后面的服务，按PROXY protocol（v1文本/v2二进制）取得真实的客户端地址
+//  - 只解析来自Trusted（CIDR或者IP，一般是负载均衡）的头部，其他地址按没有头部处理，PROXY_STRICT时会被关闭；
+//    Mode不是PROXY_OFF时Trusted不能为空
+//  - HeaderTimeout内没有收到完整的头部，PROXY_STRICT时关闭连接，PROXY_OPTIONAL时按没有头部处理；
+//    PROXY_OPTIONAL下服务端先发数据的协议，会在这里等待HeaderTimeout
+//  - 头部在单独的协程中读取，不影响Accept其他连接；同时在读取头部的连接最多MaxPending个，
+//    超过时新的连接直接关闭，避免慢速发送头部的连接占满协程
+type ProxyPolicy struct {
+	Mode          int
+	HeaderTimeout time.Duration
+	Trusted       []string
+	MaxPending    int
+}
+
+//PROXY protocol的统计
+type ProxyStats struct {
+	Proxied  uint64 // 解析到头部的连接数
+	Direct   uint64 // 没有头部的连接数
+	Rejected uint64 // 因为头部缺失或者错误被关闭的连接数
+}
+
+//解析过PROXY头部的连接，RemoteAddr/LocalAddr返回头部中的地址，已经读到缓冲中的数据在Read时先返回
+type ProxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (this *ProxyConn) Read(b []byte) (int, error) {
+	if this.reader != nil {
+		if this.reader.Buffered() > 0 {
+			return this.reader.Read(b)
+		}
+		this.reader = nil
+	}
+	return this.Conn.Read(b)
+}
+
+func (this *ProxyConn) RemoteAddr() net.Addr {
+	if this.remote != nil {
+		return this.remote
+	}
+	return this.Conn.RemoteAddr()
+}
+
+func (this *ProxyConn) LocalAddr() net.Addr {
+	if this.local != nil {
+		return this.local
+	}
+	return this.Conn.LocalAddr()
+}
+
+//连接经过代理时返回真实的客户端地址（头部为LOCAL或者UNKNOWN时为nil）
+func (this *ProxyConn) ProxiedAddr() net.Addr {
+	return this.remote
+}
+
+type proxyAccept struct {
+	policy  ProxyPolicy
+	trusted []*net.IPNet
+	conns   chan net.Conn
+	pending int32         // 正在读取头部的连接数
+	done    chan struct{} // listener关闭后关闭，err为错误
+	err     error
+	once    sync.Once
+	stats   ProxyStats
+}
+
+//设置PROXY protocol的处理方式，需要在Accept之前设置
+func (this *TCPServer) SetProxyPolicy(policy ProxyPolicy) error {
+	if policy.HeaderTimeout <= 0 {
+		policy.HeaderTimeout = 5 * time.Second
+	}
+	if policy.MaxPending <= 0 {
+		policy.MaxPending = 1024
+	}
+	if policy.Mode != PROXY_OFF && len(policy.Trusted) == 0 {
+		return ErrorProxyTrusted
+	}
+	trusted, err := parseCIDRs(policy.Trusted)
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.proxy != nil {
+		this.proxy.policy = policy
+		this.proxy.trusted = trusted
+		return nil
+	}
+	this.proxy = &proxyAccept{
+		policy:  policy,
+		trusted: trusted,
+		conns:   make(chan net.Conn, 128),
+		done:    make(chan struct{}),
+	}
+	return nil
+}
+
+func (this *TCPServer) ProxyStats() ProxyStats {
+	this.lock.Lock()
+	proxy := this.proxy
+	this.lock.Unlock()
+
+	if proxy == nil {
+		return ProxyStats{}
+	}
+	return ProxyStats{
+		Proxied:  atomic.LoadUint64(&proxy.stats.Proxied),
+		Direct:   atomic.LoadUint64(&proxy.stats.Direct),
+		Rejected: atomic.LoadUint64(&proxy.stats.Rejected),
+	}
+}
+
+//返回下一个连接，没有设置ProxyPolicy时直接从listener取
+func (this *TCPServer) acceptConn() (net.Conn, error) {
+	this.lock.Lock()
+	proxy := this.proxy
+	this.lock.Unlock()
+
+	if proxy == nil {
+		return this.listener.Accept()
+	}
+
+	proxy.once.Do(func() {
+		go this.proxyAcceptLoop(proxy)
+	})
+	select {
+	case conn := <-proxy.conns:
+		return conn, nil
+	case <-proxy.done:
+		return nil, proxy.err
+	}
+}
+
+//接受连接，每个连接在单独的协程中读取头部，完成后交给Accept
+func (this *TCPServer) proxyAcceptLoop(proxy *proxyAccept) {
+	defer RecoverPrint()
+
+	var delay time.Duration
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			//listener关闭后结束，其他错误（例如文件句柄用尽）等待一段时间后重试
+			if errors.Is(err, net.ErrClosed) {
+				proxy.err = err
+				close(proxy.done)
+				return
+			}
+			if delay == 0 {
+				delay = proxyAcceptMinDelay
+			} else if delay *= 2; delay > proxyAcceptMaxDelay {
+				delay = proxyAcceptMaxDelay
+			}
+			log.Println("TcpServer -> PROXY Accept : ", err.Error(), " retrying in ", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		this.lock.Lock()
+		policy, trusted := proxy.policy, proxy.trusted
+		this.lock.Unlock()
+
+		//不可信的地址不读取头部，直接处理，不占用握手的名额
+		if policy.Mode == PROXY_OFF || !trustedPeer(conn.RemoteAddr(), trusted) {
+			this.proxyHandshake(proxy, conn, policy, trusted)
+			continue
+		}
+
+		if atomic.AddInt32(&proxy.pending, 1) > int32(policy.MaxPending) {
+			atomic.AddInt32(&proxy.pending, -1)
+			log.Println("TcpServer -> PROXY ", conn.RemoteAddr().String(), " : too many pending handshakes")
+			atomic.AddUint64(&proxy.stats.Rejected, 1)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer atomic.AddInt32(&proxy.pending, -1)
+			this.proxyHandshake(proxy, conn, policy, trusted)
+		}()
+	}
+}
+
+//读取头部，完成后交给Accept
+func (this *TCPServer) proxyHandshake(proxy *proxyAccept, conn net.Conn, policy ProxyPolicy, trusted []*net.IPNet) {
+	defer RecoverPrint()
+
+	proxied, err := readProxyHeader(conn, policy, trusted, &proxy.stats)
+	if err != nil {
+		log.Println("TcpServer -> PROXY ", conn.RemoteAddr().String(), " : ", err.Error())
+		atomic.AddUint64(&proxy.stats.Rejected, 1)
+		conn.Close()
+		return
+	}
+	select {
+	case proxy.conns <- proxied:
+	case <-proxy.done:
+		proxied.Close()
+	}
+}
+
+//Trusted为空时不信任任何地址，避免客户端伪造头部绕过ACL和限流
+func trustedPeer(addr net.Addr, trusted []*net.IPNet) bool {
+	ip := parseIP(remoteIP(addr))
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//按policy读取PROXY头部，返回包装后的连接
+func readProxyHeader(conn net.Conn, policy ProxyPolicy, trusted []*net.IPNet, stats *ProxyStats) (net.Conn, error) {
+	if policy.Mode == PROXY_OFF {
+		return conn, nil
+	}
+
+	direct := func() (net.Conn, error) {
+		if policy.Mode == PROXY_STRICT {
+			return nil, ErrorProxyMissing
+		}
+		atomic.AddUint64(&stats.Direct, 1)
+		return conn, nil
+	}
+
+	if !trustedPeer(conn.RemoteAddr(), trusted) {
+		return direct()
+	}
+
+	conn.SetReadDeadline(time.Now().Add(policy.HeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReaderSize(conn, 256)
+	proxyConn := &ProxyConn{Conn: conn, reader: reader}
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		if policy.Mode == PROXY_OPTIONAL && isTimeout(err) {
+			return direct()
+		}
+		return nil, err
+	}
+
+	switch first[0] {
+	case 'P':
+		err = parseProxyV1(reader, proxyConn)
+	case '\r':
+		err = parseProxyV2(reader, proxyConn)
+	default:
+		err = ErrorProxyMissing
+	}
+
+	if err == ErrorProxyMissing || (err != nil && isTimeout(err) && policy.Mode == PROXY_OPTIONAL) {
+		//不是PROXY头部，已经读到的数据由ProxyConn重新返回
+		if policy.Mode == PROXY_STRICT {
+			return nil, err
+		}
+		atomic.AddUint64(&stats.Direct, 1)
+		return proxyConn, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddUint64(&stats.Proxied, 1)
+	return proxyConn, nil
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+//v1: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"，或者"PROXY UNKNOWN ...\r\n"
+func parseProxyV1(reader *bufio.Reader, conn *ProxyConn) error {
+	prefix, err := reader.Peek(6)
+	if err != nil {
+		return err
+	}
+	if string(prefix) != "PROXY " {
+		return ErrorProxyMissing
+	}
+
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return ErrorProxyHeader
+		}
+		return err
+	}
+	if len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrorProxyHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line) - 2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return ErrorProxyHeader
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return ErrorProxyHeader
+	}
+	conn.remote = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	conn.local = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return nil
+}
+
+//v2: signature(12) ver_cmd(1) fam(1) len(2) addresses TLVs
+func parseProxyV2(reader *bufio.Reader, conn *ProxyConn) error {
+	header, err := reader.Peek(16)
+	if err != nil {
+		//不够16字节时看已经收到的部分是否匹配
+		if n := reader.Buffered(); n < len(proxyV2Signature) {
+			if partial, _ := reader.Peek(n); !bytes.HasPrefix(proxyV2Signature, partial) {
+				return ErrorProxyMissing
+			}
+		}
+		return err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return ErrorProxyMissing
+	}
+
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if verCmd >> 4 != 2 {
+		return ErrorProxyHeader
+	}
+	reader.Discard(16)
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return err
+	}
+
+	switch verCmd & 0x0F {
+	case 0x00:
+		//LOCAL：负载均衡自己的连接（如健康检查），使用原始地址
+		return nil
+	case 0x01:
+	default:
+		return ErrorProxyHeader
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return ErrorProxyHeader
+		}
+		conn.remote = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		conn.local = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return ErrorProxyHeader
+		}
+		conn.remote = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		conn.local = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	default:
+		//UNSPEC、UDP、UNIX等使用原始地址
+	}
+	return nil
+}
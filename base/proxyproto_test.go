@@ -0,0 +1,196 @@
+package base
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(verCmd byte, family byte, payload []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func proxyV2IPv4(src, dst string, srcPort, dstPort uint16) []byte {
+	payload := append([]byte(nil), net.ParseIP(src).To4()...)
+	payload = append(payload, net.ParseIP(dst).To4()...)
+	payload = binary.BigEndian.AppendUint16(payload, srcPort)
+	return binary.BigEndian.AppendUint16(payload, dstPort)
+}
+
+func proxyV2IPv6(src, dst string, srcPort, dstPort uint16) []byte {
+	payload := append([]byte(nil), net.ParseIP(src).To16()...)
+	payload = append(payload, net.ParseIP(dst).To16()...)
+	payload = binary.BigEndian.AppendUint16(payload, srcPort)
+	return binary.BigEndian.AppendUint16(payload, dstPort)
+}
+
+func TestParseProxyV1(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		err    error
+		remote string
+	}{
+		{"tcp4", "PROXY TCP4 1.2.3.4 5.6.7.8 1111 443\r\n", nil, "1.2.3.4:1111"},
+		{"tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 1111 443\r\n", nil, "[2001:db8::1]:1111"},
+		{"unknown", "PROXY UNKNOWN\r\n", nil, ""},
+		{"not proxy", "GET / HTTP/1.1\r\n", ErrorProxyMissing, ""},
+		{"missing fields", "PROXY TCP4 1.2.3.4 5.6.7.8 1111\r\n", ErrorProxyHeader, ""},
+		{"bad protocol", "PROXY UDP4 1.2.3.4 5.6.7.8 1111 443\r\n", ErrorProxyHeader, ""},
+		{"bad ip", "PROXY TCP4 1.2.3.400 5.6.7.8 1111 443\r\n", ErrorProxyHeader, ""},
+		{"bad port", "PROXY TCP4 1.2.3.4 5.6.7.8 70000 443\r\n", ErrorProxyHeader, ""},
+		{"no crlf", "PROXY TCP4 1.2.3.4 5.6.7.8 1111 443\n", ErrorProxyHeader, ""},
+		{"oversized", "PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n", ErrorProxyHeader, ""},
+		{"longer than buffer", "PROXY " + strings.Repeat("x", 300), ErrorProxyHeader, ""},
+	}
+
+	for _, test := range tests {
+		conn := &ProxyConn{}
+		reader := bufio.NewReaderSize(strings.NewReader(test.input), 256)
+		err := parseProxyV1(reader, conn)
+		if err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && addrString(conn.ProxiedAddr()) != test.remote {
+			t.Errorf("%s: remote = %v, want %q", test.name, conn.ProxiedAddr(), test.remote)
+		}
+	}
+}
+
+func TestParseProxyV1Truncated(t *testing.T) {
+	conn := &ProxyConn{}
+	reader := bufio.NewReaderSize(strings.NewReader("PROXY TCP4 1.2.3.4 5.6."), 256)
+	if err := parseProxyV1(reader, conn); err == nil {
+		t.Fatalf("truncated header accepted, remote %v", conn.ProxiedAddr())
+	}
+}
+
+func TestParseProxyV2(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []byte
+		err    error
+		remote string
+		local  string
+	}{
+		{"tcp4", proxyV2Header(0x21, 0x11, proxyV2IPv4("1.2.3.4", "5.6.7.8", 1111, 443)),
+			nil, "1.2.3.4:1111", "5.6.7.8:443"},
+		{"tcp6", proxyV2Header(0x21, 0x21, proxyV2IPv6("2001:db8::1", "2001:db8::2", 1111, 443)),
+			nil, "[2001:db8::1]:1111", "[2001:db8::2]:443"},
+		{"tcp4 with tlv", proxyV2Header(0x21, 0x11, append(proxyV2IPv4("1.2.3.4", "5.6.7.8", 1, 2), 0x01, 0, 1, 'h')),
+			nil, "1.2.3.4:1", "5.6.7.8:2"},
+		{"local", proxyV2Header(0x20, 0x00, nil), nil, "", ""},
+		{"unspec family", proxyV2Header(0x21, 0x00, nil), nil, "", ""},
+		{"bad version", proxyV2Header(0x11, 0x11, proxyV2IPv4("1.2.3.4", "5.6.7.8", 1, 2)), ErrorProxyHeader, "", ""},
+		{"bad command", proxyV2Header(0x22, 0x11, proxyV2IPv4("1.2.3.4", "5.6.7.8", 1, 2)), ErrorProxyHeader, "", ""},
+		{"short ipv4", proxyV2Header(0x21, 0x11, []byte{1, 2, 3, 4}), ErrorProxyHeader, "", ""},
+		{"short ipv6", proxyV2Header(0x21, 0x21, proxyV2IPv4("1.2.3.4", "5.6.7.8", 1, 2)), ErrorProxyHeader, "", ""},
+		{"not proxy", []byte("\r\nGET / HTTP/1.1\r\n\r\n"), ErrorProxyMissing, "", ""},
+	}
+
+	for _, test := range tests {
+		conn := &ProxyConn{}
+		reader := bufio.NewReaderSize(bytes.NewReader(test.input), 256)
+		err := parseProxyV2(reader, conn)
+		if err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if addrString(conn.remote) != test.remote || addrString(conn.local) != test.local {
+			t.Errorf("%s: remote %v local %v, want %q %q", test.name, conn.remote, conn.local, test.remote, test.local)
+		}
+	}
+}
+
+func TestParseProxyV2Truncated(t *testing.T) {
+	full := proxyV2Header(0x21, 0x11, proxyV2IPv4("1.2.3.4", "5.6.7.8", 1111, 443))
+	oversized := proxyV2Header(0x21, 0x11, proxyV2IPv4("1.2.3.4", "5.6.7.8", 1111, 443))
+	binary.BigEndian.PutUint16(oversized[14:], 0xFFFF)
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"signature only", full[:12]},
+		{"no length", full[:14]},
+		{"short payload", full[:20]},
+		{"length beyond data", oversized},
+	}
+
+	for _, test := range tests {
+		conn := &ProxyConn{}
+		reader := bufio.NewReaderSize(bytes.NewReader(test.input), 256)
+		if err := parseProxyV2(reader, conn); err == nil {
+			t.Errorf("%s: truncated header accepted, remote %v", test.name, conn.remote)
+		}
+	}
+}
+
+//RemoteAddr可以指定的连接，模拟来自不同地址的对端
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (this *addrConn) RemoteAddr() net.Addr {
+	return this.remote
+}
+
+func TestReadProxyHeaderTrust(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := "PROXY TCP4 1.2.3.4 5.6.7.8 1111 443\r\n"
+
+	tests := []struct {
+		name    string
+		peer    string
+		mode    int
+		trusted []*net.IPNet
+		err     error
+		remote  string
+	}{
+		{"trusted", "10.1.1.1", PROXY_OPTIONAL, trusted, nil, "1.2.3.4:1111"},
+		{"spoofed optional", "192.168.1.1", PROXY_OPTIONAL, trusted, nil, "192.168.1.1:5000"},
+		{"spoofed strict", "192.168.1.1", PROXY_STRICT, trusted, ErrorProxyMissing, ""},
+		{"no trusted list", "10.1.1.1", PROXY_OPTIONAL, nil, nil, "10.1.1.1:5000"},
+	}
+
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(header))
+		}()
+
+		conn := &addrConn{Conn: server, remote: &net.TCPAddr{IP: net.ParseIP(test.peer), Port: 5000}}
+		policy := ProxyPolicy{Mode: test.mode, HeaderTimeout: time.Second}
+		var stats ProxyStats
+		proxied, err := readProxyHeader(conn, policy, test.trusted, &stats)
+		if err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+		} else if err == nil && proxied.RemoteAddr().String() != test.remote {
+			t.Errorf("%s: remote = %v, want %s", test.name, proxied.RemoteAddr(), test.remote)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
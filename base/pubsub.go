@@ -0,0 +1,241 @@
+package base
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/sotter/dovenet/protocol"
+	log "github.com/sotter/dovenet/log"
+)
+
+//订阅者发送队列满时的处理方式
+const (
+	SLOW_SUBSCRIBER_DROP  = iota // 丢弃这条消息
+	SLOW_SUBSCRIBER_BLOCK        // 最多等待Timeout，超时后丢弃
+	SLOW_SUBSCRIBER_CLOSE        // 断开这个订阅者
+)
+
+type PubSubStats struct {
+	Published    uint64 // 发布的消息数
+	Delivered    uint64 // 投递成功的次数
+	Dropped      uint64 // 因为订阅者发送队列满而丢弃的次数
+	Disconnected uint64 // 因为处理太慢被断开的订阅者数
+}
+
+//基于TCPServer的发布订阅，客户端通过保留的MsgType订阅、取消订阅和发布，见protocol/pubsub.go
+//其他消息以及连接事件交给NetworkCB处理
+type PubSubBroker struct {
+	Manager   *Manager
+	NetworkCB NetworkCallBack
+
+	SlowPolicy int
+	Timeout    time.Duration // SLOW_SUBSCRIBER_BLOCK时的最长等待时间
+
+	//客户端发布的权限检查，为nil时允许所有客户端发布
+	PublishFilter func(conn *TcpConnection, topic string) bool
+
+	//订阅关系，匹配模式 -> 订阅的连接，和Manager的分组分开，连接关闭时自动退出
+	subs     *sessionIndex
+	hooked   map[uint64]struct{} // 已经注册了关闭清理的连接，由lock保护
+
+	//所有被订阅过的匹配模式，订阅者都退出之后在Publish时清理
+	lock     sync.RWMutex
+	patterns map[string]struct{}
+
+	stats PubSubStats
+}
+
+func NewPubSubBroker(m *Manager, networkcb NetworkCallBack) *PubSubBroker {
+	return &PubSubBroker{
+		Manager:    m,
+		NetworkCB:  networkcb,
+		SlowPolicy: SLOW_SUBSCRIBER_DROP,
+		Timeout:    100 * time.Millisecond,
+		subs:       newSessionIndex(),
+		hooked:     make(map[uint64]struct{}),
+		patterns:   make(map[string]struct{}),
+	}
+}
+
+func (this *PubSubBroker) Subscribe(conn *TcpConnection, pattern string) error {
+	if err := protocol.ValidTopicPattern(pattern); err != nil {
+		return err
+	}
+
+	if this.Manager.GetSession(conn.ConnID) != conn {
+		return ErrorParameter
+	}
+
+	//和Publish中的清理互斥，保证加入订阅和登记模式是原子的
+	this.lock.Lock()
+	this.subs.add(pattern, conn)
+	this.patterns[pattern] = struct{}{}
+	_, hooked := this.hooked[conn.ConnID]
+	this.hooked[conn.ConnID] = struct{}{}
+	this.lock.Unlock()
+
+	//每个连接只注册一次关闭时的清理，AddCloseHook对已经关闭的连接会立即调用，所以不能持有lock
+	if !hooked {
+		connId := conn.ConnID
+		conn.AddCloseHook(func() {
+			this.subs.removeConn(connId)
+			this.lock.Lock()
+			delete(this.hooked, connId)
+			this.lock.Unlock()
+		})
+	}
+	if conn.IsClosed() {
+		this.subs.removeConn(conn.ConnID)
+		return ErrorConnClosed
+	}
+	return nil
+}
+
+func (this *PubSubBroker) Unsubscribe(conn *TcpConnection, pattern string) error {
+	if err := protocol.ValidTopicPattern(pattern); err != nil {
+		return err
+	}
+	this.subs.remove(pattern, conn.ConnID)
+	return nil
+}
+
+//连接当前订阅的所有模式
+func (this *PubSubBroker) Subscriptions(conn *TcpConnection) []string {
+	return this.subs.keysOf(conn.ConnID)
+}
+
+//找到topic的所有订阅者，一个连接匹配多个模式时只算一次
+func (this *PubSubBroker) subscribers(topic string) []*TcpConnection {
+	var empty []string
+	seen := make(map[uint64]struct{})
+	var conns []*TcpConnection
+
+	this.lock.RLock()
+	for pattern := range this.patterns {
+		if !protocol.MatchTopic(pattern, topic) {
+			continue
+		}
+		members := this.subs.get(pattern)
+		if len(members) == 0 {
+			empty = append(empty, pattern)
+			continue
+		}
+		for _, conn := range members {
+			if _, exist := seen[conn.ConnID]; !exist {
+				seen[conn.ConnID] = struct{}{}
+				conns = append(conns, conn)
+			}
+		}
+	}
+	this.lock.RUnlock()
+
+	if len(empty) > 0 {
+		this.lock.Lock()
+		for _, pattern := range empty {
+			if this.subs.count(pattern) == 0 {
+				delete(this.patterns, pattern)
+			}
+		}
+		this.lock.Unlock()
+	}
+
+	return conns
+}
+
+//服务端发布，返回每个订阅者的投递结果
+func (this *PubSubBroker) Publish(topic string, payload []byte) ([]BroadcastResult, error) {
+	if err := protocol.ValidTopic(topic); err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&this.stats.Published, 1)
+
+	opt := &BroadcastOption{}
+	if this.SlowPolicy == SLOW_SUBSCRIBER_BLOCK {
+		opt.Timeout = this.Timeout
+		opt.Concurrency = 8
+	}
+
+	results := broadcast(this.subscribers(topic), protocol.NewTopicDataMsg(topic, payload), opt)
+	for _, result := range results {
+		switch result.Status {
+		case DELIVERY_SENT:
+			atomic.AddUint64(&this.stats.Delivered, 1)
+		case DELIVERY_DROPPED:
+			atomic.AddUint64(&this.stats.Dropped, 1)
+			if this.SlowPolicy == SLOW_SUBSCRIBER_CLOSE {
+				atomic.AddUint64(&this.stats.Disconnected, 1)
+				log.Println("PubSubBroker -> close slow subscriber ", result.Conn.String())
+				//Close会等待连接的所有协程退出，不能阻塞发布者
+				go result.Conn.Close()
+			}
+		}
+	}
+	return results, nil
+}
+
+func (this *PubSubBroker) Stats() PubSubStats {
+	return PubSubStats{
+		Published:    atomic.LoadUint64(&this.stats.Published),
+		Delivered:    atomic.LoadUint64(&this.stats.Delivered),
+		Dropped:      atomic.LoadUint64(&this.stats.Dropped),
+		Disconnected: atomic.LoadUint64(&this.stats.Disconnected),
+	}
+}
+
+func (this *PubSubBroker) OnMessageData(conn *TcpConnection, msg protocol.Message) error {
+	cm, ok := msg.(*protocol.CommMsg)
+	if !ok {
+		return this.forward(conn, msg)
+	}
+
+	switch cm.Header.MsgType {
+	case protocol.MSG_SUBSCRIBE:
+		return this.replyError(conn, cm, this.Subscribe(conn, string(cm.Body)))
+
+	case protocol.MSG_UNSUBSCRIBE:
+		return this.replyError(conn, cm, this.Unsubscribe(conn, string(cm.Body)))
+
+	case protocol.MSG_PUBLISH:
+		topic, payload, err := protocol.ParseTopicMsg(cm)
+		if err != nil {
+			return err
+		}
+		if this.PublishFilter != nil && !this.PublishFilter(conn, topic) {
+			log.Println("PubSubBroker -> publish denied ", topic, " ", conn.String())
+			return nil
+		}
+		_, err = this.Publish(topic, payload)
+		return err
+
+	default:
+		return this.forward(conn, msg)
+	}
+}
+
+//订阅或取消订阅失败时告诉客户端，见protocol.MSG_SUBSCRIBE
+func (this *PubSubBroker) replyError(conn *TcpConnection, req *protocol.CommMsg, err error) error {
+	if err != nil {
+		log.Println("PubSubBroker -> ", err.Error(), " ", conn.String())
+		conn.TryWrite(protocol.NewErrorReply(req, err.Error()))
+	}
+	return err
+}
+
+func (this *PubSubBroker) forward(conn *TcpConnection, msg protocol.Message) error {
+	if this.NetworkCB != nil {
+		return this.NetworkCB.OnMessageData(conn, msg)
+	}
+	return nil
+}
+
+func (this *PubSubBroker) OnConnection(conn *TcpConnection) {
+	if this.NetworkCB != nil {
+		this.NetworkCB.OnConnection(conn)
+	}
+}
+
+func (this *PubSubBroker) OnDisConnection(conn *TcpConnection) {
+	if this.NetworkCB != nil {
+		this.NetworkCB.OnDisConnection(conn)
+	}
+}
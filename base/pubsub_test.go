@@ -0,0 +1,83 @@
+package base
+
+import (
+	"testing"
+
+	"github.com/sotter/dovenet/protocol"
+)
+
+//订阅和Manager的分组互不影响
+func TestPubSubOwnIndex(t *testing.T) {
+	manager := NewManager()
+	broker := NewPubSubBroker(manager, nil)
+	subscriber := newManagedConn(manager, 1, "a:1")
+	member := newManagedConn(manager, 2, "b:1")
+
+	if err := broker.Subscribe(subscriber, "quote.*"); err != nil {
+		t.Fatal(err)
+	}
+	manager.Join("pubsub:quote.*", member)
+	manager.Join("quote.*", member)
+
+	if groups := manager.Groups(subscriber); len(groups) != 0 {
+		t.Errorf("subscription leaked into groups: %v", groups)
+	}
+	results, err := broker.Publish("quote.sh", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Conn != subscriber {
+		t.Errorf("published to %d subscribers, want only the subscriber", len(results))
+	}
+	if subs := broker.Subscriptions(member); len(subs) != 0 {
+		t.Errorf("group member subscriptions = %v", subs)
+	}
+
+	subscriber.Close()
+	if subs := broker.Subscriptions(subscriber); len(subs) != 0 {
+		t.Errorf("subscriptions after close = %v", subs)
+	}
+	if err := broker.Subscribe(subscriber, "quote.*"); err == nil {
+		t.Errorf("subscribed a closed connection")
+	}
+}
+
+//订阅失败时给客户端回错误
+func TestPubSubErrorReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     *protocol.CommMsg
+		replied bool
+	}{
+		{"subscribe", protocol.NewSubscribeMsg("quote.#"), false},
+		{"bad pattern", protocol.NewSubscribeMsg("quote.#.sh"), true},
+		{"empty pattern", protocol.NewSubscribeMsg(""), true},
+		{"unsubscribe", protocol.NewUnsubscribeMsg("quote.#"), false},
+		{"bad unsubscribe", protocol.NewUnsubscribeMsg("a..b"), true},
+	}
+
+	for _, test := range tests {
+		manager := NewManager()
+		broker := NewPubSubBroker(manager, nil)
+		conn := newManagedConn(manager, 1, "a:1")
+
+		err := broker.OnMessageData(conn, test.msg)
+		if (err != nil) != test.replied {
+			t.Errorf("%s: err = %v", test.name, err)
+		}
+		if !test.replied {
+			if conn.QueueLen() != 0 {
+				t.Errorf("%s: unexpected reply", test.name)
+			}
+			conn.Close()
+			continue
+		}
+
+		reply, ok := (<-conn.messageSendChan).(*protocol.CommMsg)
+		if !ok || reply.Header.MsgType != test.msg.Header.MsgType ||
+			reply.Header.Flags & protocol.FlagError == 0 || string(reply.Body) != err.Error() {
+			t.Errorf("%s: reply = %+v", test.name, reply)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,68 @@
+package base
+
+import (
+	"sync"
+	"time"
+)
+
+//令牌桶，客户端的发送限制和服务端的入站限制共用
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64 // 每秒补充的令牌
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+//取n个令牌，需要等待时返回等待的时间，这n个令牌已经预定，之后的请求排在后面；
+//maxWait小于0时不限制等待时间，等待时间超过maxWait时不取令牌并返回false
+//n超过burst时同样可以预定，只是需要等待
+func (this *tokenBucket) take(n float64, maxWait time.Duration) (time.Duration, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+
+	if this.tokens >= n {
+		this.tokens -= n
+		return 0, true
+	}
+
+	need := time.Duration((n - this.tokens) / this.rate * float64(time.Second))
+	if maxWait >= 0 && need > maxWait {
+		return 0, false
+	}
+	this.tokens -= n
+	return need, true
+}
+
+//退回take取走的n个令牌，用于同时检查多个桶时，后面的桶拒绝了请求
+func (this *tokenBucket) refund(n float64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.tokens += n
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+}
@@ -0,0 +1,33 @@
+package base
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	bucket := newTokenBucket(10, 2)
+
+	for i := 0; i < 2; i++ {
+		if wait, ok := bucket.take(1, 0); !ok || wait != 0 {
+			t.Fatalf("take %d within burst = %v, %v", i, wait, ok)
+		}
+	}
+	if _, ok := bucket.take(1, 0); ok {
+		t.Fatal("take beyond burst without waiting succeeded")
+	}
+
+	//预定的令牌需要等待，之后的请求排在后面
+	wait, ok := bucket.take(1, -1)
+	if !ok || wait < 50*time.Millisecond || wait > 100*time.Millisecond {
+		t.Fatalf("reserved wait = %v, %v, want about 100ms", wait, ok)
+	}
+	if wait, ok = bucket.take(1, -1); !ok || wait < 150*time.Millisecond {
+		t.Errorf("second reserved wait = %v, want about 200ms", wait)
+	}
+
+	bucket.refund(10)
+	if bucket.tokens != bucket.burst {
+		t.Errorf("tokens after refund = %v, want capped at %v", bucket.tokens, bucket.burst)
+	}
+}
@@ -0,0 +1,134 @@
+package base
+
+import (
+	"sync/atomic"
+	"time"
+	"github.com/sotter/dovenet/protocol"
+)
+
+//一个等待回应的请求
+type pendingCall struct {
+	callback func(reply *protocol.CommMsg, err error)
+	timer    *time.Timer
+}
+
+func (this *TcpConnection) nextSeq() uint32 {
+	for {
+		//Seq为0表示没有序列号，跳过
+		if seq := atomic.AddUint32(&this.seq, 1); seq != 0 {
+			return seq
+		}
+	}
+}
+
+//发送请求，收到对应Seq的回应（带FlagReply）或者超时后调用callback
+//  - 依赖v2头部的Seq，连接的CommProtocol.Version需要设置为2并打开V2First（或者对端已经发来过v2的包），
+//    对端按请求的Seq回应，见protocol.NewReplyMsg；现在只能发送v1头部时立即返回ErrorNoSeq
+//  - msg不会被修改，可以同时发给多个连接
+//  - callback在读协程或者定时器协程中调用，不能阻塞；带FlagError的回应同样通过reply返回
+func (this *TcpConnection) Request(msg *protocol.CommMsg, timeout time.Duration,
+	callback func(reply *protocol.CommMsg, err error)) error {
+
+	if !this.SeqSupported() {
+		return ErrorNoSeq
+	}
+
+	req := &protocol.CommMsg{
+		Header: msg.Header,
+		Body:   msg.Body,
+	}
+	req.Header.Seq = this.nextSeq()
+	req.Header.Flags &^= protocol.FlagReply
+
+	call := &pendingCall{
+		callback: callback,
+	}
+
+	this.pendingLock.Lock()
+	if this.pending == nil {
+		this.pending = make(map[uint32]*pendingCall)
+	}
+	this.pending[req.Header.Seq] = call
+	call.timer = time.AfterFunc(timeout, func() {
+		if this.takeCall(req.Header.Seq) != nil {
+			callback(nil, ErrorTimeout)
+		}
+	})
+	this.pendingLock.Unlock()
+
+	switch this.TryWrite(req) {
+	case DELIVERY_SENT:
+		return nil
+	case DELIVERY_DROPPED:
+		if this.takeCall(req.Header.Seq) != nil {
+			return ErrorWouldBlock
+		}
+	default:
+		if this.takeCall(req.Header.Seq) != nil {
+			return ErrorConnClosed
+		}
+	}
+
+	//已经被超时或者连接关闭处理过了，callback已经调用
+	return nil
+}
+
+//连接现在发送的消息能否带上Seq，v1头部会丢掉Seq，请求永远等不到回应
+func (this *TcpConnection) SeqSupported() bool {
+	conn, ok := this.conn.(protocol.SeqConn)
+	return ok && conn.SeqSupported()
+}
+
+//取出并删除等待中的请求，同时停掉定时器
+func (this *TcpConnection) takeCall(seq uint32) *pendingCall {
+	this.pendingLock.Lock()
+	defer this.pendingLock.Unlock()
+
+	call, exist := this.pending[seq]
+	if !exist {
+		return nil
+	}
+	delete(this.pending, seq)
+	call.timer.Stop()
+	if len(this.pending) == 0 {
+		select {
+		case this.callsDone <- struct{}{}:
+		default:
+		}
+	}
+	return call
+}
+
+//收到回应时找到对应的请求，没有对应的请求（如已经超时）返回false，交给业务层处理
+func (this *TcpConnection) completeCall(reply *protocol.CommMsg) bool {
+	if reply.Header.Flags & protocol.FlagReply == 0 || reply.Header.Seq == 0 {
+		return false
+	}
+
+	call := this.takeCall(reply.Header.Seq)
+	if call == nil {
+		return false
+	}
+	call.callback(reply, nil)
+	return true
+}
+
+//连接关闭时所有等待中的请求返回ErrorConnClosed
+func (this *TcpConnection) failPendingCalls() {
+	this.pendingLock.Lock()
+	pending := this.pending
+	this.pending = nil
+	this.pendingLock.Unlock()
+
+	for _, call := range pending {
+		call.timer.Stop()
+		call.callback(nil, ErrorConnClosed)
+	}
+}
+
+//等待回应的请求数
+func (this *TcpConnection) PendingCalls() int {
+	this.pendingLock.Lock()
+	defer this.pendingLock.Unlock()
+	return len(this.pending)
+}
@@ -0,0 +1,142 @@
+package base
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sotter/dovenet/protocol"
+)
+
+//MsgType 1原样回应包体，其他的不回应
+type replyCallBack struct {
+	nopCallBack
+}
+
+func (this replyCallBack) OnMessageData(conn *TcpConnection, msg protocol.Message) error {
+	if req, ok := msg.(*protocol.CommMsg); ok && req.Header.MsgType == 1 {
+		return conn.Write(protocol.NewReplyMsg(req, 1, req.Body))
+	}
+	return nil
+}
+
+//用net.Pipe连起来的一对已经启动的连接
+func newPipeConns(client *protocol.CommProtocol, server *protocol.CommProtocol,
+	cb NetworkCallBack) (*TcpConnection, *TcpConnection) {
+
+	c, s := net.Pipe()
+	clientConn := NewClientConn(1, protocol.NewCommCodec(c, client), 16, nopCallBack{})
+	clientConn.SetHeartBeatInterval(0)
+	serverConn := NewServerConn(2, protocol.NewCommCodec(s, server), cb, nil)
+	clientConn.Start()
+	serverConn.Start()
+	return clientConn, serverConn
+}
+
+func v2Protocol() *protocol.CommProtocol {
+	return &protocol.CommProtocol{Version: 2, V2First: true}
+}
+
+func TestRequestReplyMatching(t *testing.T) {
+	client, server := newPipeConns(v2Protocol(), v2Protocol(), replyCallBack{})
+	defer server.Close()
+	defer client.Close()
+
+	type result struct {
+		body string
+		err  error
+	}
+	const count = 10
+	results := make([]chan result, count)
+	for i := 0; i < count; i++ {
+		results[i] = make(chan result, 1)
+		done := results[i]
+		err := client.Request(protocol.NewCommMsg(1, []byte(fmt.Sprint(i))), time.Second,
+			func(reply *protocol.CommMsg, err error) {
+				if err != nil {
+					done <- result{"", err}
+					return
+				}
+				done <- result{string(reply.Body), nil}
+			})
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		res := <-results[i]
+		if res.err != nil || res.body != fmt.Sprint(i) {
+			t.Errorf("request %d: reply %q, err %v", i, res.body, res.err)
+		}
+	}
+	if n := client.PendingCalls(); n != 0 {
+		t.Errorf("pending calls = %d, want 0", n)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	client, server := newPipeConns(v2Protocol(), v2Protocol(), replyCallBack{})
+	defer server.Close()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	start := time.Now()
+	err := client.Request(protocol.NewCommMsg(2, nil), 20 * time.Millisecond, func(reply *protocol.CommMsg, err error) {
+		done <- err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrorTimeout {
+		t.Errorf("err = %v, want ErrorTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20 * time.Millisecond {
+		t.Errorf("timed out after %v", elapsed)
+	}
+	if n := client.PendingCalls(); n != 0 {
+		t.Errorf("pending calls = %d, want 0", n)
+	}
+}
+
+func TestRequestConnClosed(t *testing.T) {
+	client, server := newPipeConns(v2Protocol(), v2Protocol(), replyCallBack{})
+	defer server.Close()
+
+	done := make(chan error, 1)
+	err := client.Request(protocol.NewCommMsg(2, nil), time.Minute, func(reply *protocol.CommMsg, err error) {
+		done <- err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if err := <-done; err != ErrorConnClosed {
+		t.Errorf("err = %v, want ErrorConnClosed", err)
+	}
+}
+
+//只能发送v1头部时Seq会被丢掉，立即返回错误而不是等到超时
+func TestRequestNeedsV2(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol *protocol.CommProtocol
+		err      error
+	}{
+		{"no protocol", nil, ErrorNoSeq},
+		{"v1", &protocol.CommProtocol{}, ErrorNoSeq},
+		{"v2 without V2First", &protocol.CommProtocol{Version: 2}, ErrorNoSeq},
+		{"v2 first", v2Protocol(), nil},
+	}
+
+	for _, test := range tests {
+		client, server := newPipeConns(test.protocol, v2Protocol(), replyCallBack{})
+		err := client.Request(protocol.NewCommMsg(1, nil), time.Second, func(reply *protocol.CommMsg, err error) {})
+		if err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
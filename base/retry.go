@@ -0,0 +1,185 @@
+package base
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	log "github.com/sotter/dovenet/log"
+)
+
+//SendData和Call失败时换一个连接重试的策略
+//  - 没有发出去的（队列满、连接关闭、熔断、没有可用连接）总是可以重试
+//  - 已经发出去的Call超时或者连接断开，只有Idempotent中的MsgType才重试；对端返回的错误回应不重试
+//  - 重试受预算限制：每个请求向预算中存入BudgetRatio，每次重试消耗1，最多存MaxTokens（开始时是满的），
+//    避免后端整体故障时重试把流量放大
+//  - 重试前的Backoff在调用者的协程中等待，SendData（包括队列满时）和Call会因此阻塞，
+//    不能阻塞的调用者不要设置Backoff
+type RetryPolicy struct {
+	MaxAttempts int                   // 总的尝试次数，包括第一次
+	Backoff     time.Duration         // 第一次重试前的等待，之后每次翻倍
+	MaxBackoff  time.Duration
+	BudgetRatio float64
+	MaxTokens   int
+	Idempotent  map[uint16]bool
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		MaxBackoff:  time.Second,
+		BudgetRatio: 0.1,
+		MaxTokens:   10,
+	}
+}
+
+//重试的统计
+type RetryStats struct {
+	Retries         uint64 // 重试的次数
+	BudgetExhausted uint64 // 因为预算不足放弃的重试
+}
+
+type retryBudget struct {
+	lock   sync.Mutex
+	tokens float64
+	max    float64
+	ratio  float64
+}
+
+func (this *retryBudget) deposit() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.tokens += this.ratio
+	if this.tokens > this.max {
+		this.tokens = this.max
+	}
+}
+
+func (this *retryBudget) withdraw() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.tokens < 1 {
+		return false
+	}
+	this.tokens--
+	return true
+}
+
+//设置重试策略，对SendData、SendTyped和Call生效
+func (this *TransPortClient) SetRetryPolicy(policy RetryPolicy) {
+	defaults := DefaultRetryPolicy()
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaults.MaxAttempts
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = defaults.MaxBackoff
+	}
+	if policy.BudgetRatio <= 0 {
+		policy.BudgetRatio = defaults.BudgetRatio
+	}
+	if policy.MaxTokens <= 0 {
+		policy.MaxTokens = defaults.MaxTokens
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.retry = &policy
+	this.retryBudget = &retryBudget{
+		tokens: float64(policy.MaxTokens),
+		max:    float64(policy.MaxTokens),
+		ratio:  policy.BudgetRatio,
+	}
+}
+
+func (this *TransPortClient) RetryStats() RetryStats {
+	return RetryStats{
+		Retries:         atomic.LoadUint64(&this.retryStats.Retries),
+		BudgetExhausted: atomic.LoadUint64(&this.retryStats.BudgetExhausted),
+	}
+}
+
+//在name对应的组中执行do，失败并且retryable时换一个没有试过的地址重试
+//  - do返回的error为nil时成功
+//  - 没有可用连接时返回上一次的错误，一次都没有执行时返回noConnError
+func (this *TransPortClient) withRetry(name string, do func(conn *TcpConnection) error,
+	retryable func(err error) bool) error {
+
+	manager := this.groupManager(name)
+	if manager == nil {
+		return ErrorNoConnection
+	}
+
+	this.lock.RLock()
+	policy, budget := this.retry, this.retryBudget
+	this.lock.RUnlock()
+
+	attempts := 1
+	if policy != nil {
+		attempts = policy.MaxAttempts
+		budget.deposit()
+	}
+
+	//按地址记录，重试要换一个节点，而不是同一个节点的另一个连接
+	var tried map[string]bool
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if !retryable(err) {
+				break
+			}
+			if !budget.withdraw() {
+				atomic.AddUint64(&this.retryStats.BudgetExhausted, 1)
+				log.Println("Retry -> budget exhausted ", name, " : ", err.Error())
+				break
+			}
+			atomic.AddUint64(&this.retryStats.Retries, 1)
+
+			//在调用者的协程中等待，见RetryPolicy
+			if backoff := retryBackoff(policy, i); backoff > 0 {
+				time.Sleep(backoff)
+			}
+		}
+
+		tcpConn := manager.GetRotationSessionExceptAddress(tried)
+		if tcpConn == nil {
+			if err == nil {
+				err = this.noConnError(name)
+			}
+			break
+		}
+
+		if err = do(tcpConn); err == nil {
+			return nil
+		}
+
+		if tried == nil {
+			tried = make(map[string]bool)
+		}
+		tried[tcpConn.Address] = true
+	}
+	return err
+}
+
+//第attempt次重试前的等待
+func retryBackoff(policy *RetryPolicy, attempt int) time.Duration {
+	backoff := policy.Backoff
+	for i := 1; i < attempt && backoff < policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+	return backoff
+}
+
+//已经发出去的请求能否重试
+func (this *TransPortClient) idempotent(msgType uint16) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.retry != nil && this.retry.Idempotent[msgType]
+}
+
+func (this *TransPortClient) retryEnabled() bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.retry != nil
+}
@@ -0,0 +1,90 @@
+package base
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+//每个地址放conns个连接，连接不启动，只用于选择
+func newTestGroup(client *TransPortClient, name string, addresses []string, conns int) {
+	id := uint64(1)
+	for _, address := range addresses {
+		for i := 0; i < conns; i++ {
+			conn := NewClientConn(id, nil, 1, nopCallBack{})
+			conn.Name = name
+			conn.Address = address
+			client.RegisterConnServer(conn)
+			id++
+		}
+	}
+}
+
+func TestRetryExcludesAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		conns     int
+		attempts  int
+		want      int
+	}{
+		{"one address many conns", []string{"a:1"}, 3, 3, 1},
+		{"two addresses", []string{"a:1", "b:1"}, 2, 3, 2},
+		{"limited by attempts", []string{"a:1", "b:1", "c:1"}, 1, 2, 2},
+		{"all addresses", []string{"a:1", "b:1", "c:1"}, 2, 5, 3},
+	}
+
+	failed := errors.New("failed")
+	for _, test := range tests {
+		client := NewTransPortClient()
+		newTestGroup(client, "g", test.addresses, test.conns)
+		client.SetRetryPolicy(RetryPolicy{MaxAttempts: test.attempts, BudgetRatio: 1, MaxTokens: 10})
+
+		tried := make(map[string]int)
+		calls := 0
+		err := client.withRetry("g", func(conn *TcpConnection) error {
+			tried[conn.Address]++
+			calls++
+			return failed
+		}, func(err error) bool {
+			return true
+		})
+		if err != failed {
+			t.Errorf("%s: err = %v, want %v", test.name, err, failed)
+		}
+		if calls != test.want || len(tried) != test.want {
+			t.Errorf("%s: %d attempts on %v, want %d distinct addresses", test.name, calls, tried, test.want)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	client := NewTransPortClient()
+	newTestGroup(client, "g", []string{"a:1", "b:1", "c:1"}, 1)
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BudgetRatio: 0.1, MaxTokens: 1})
+
+	failed := errors.New("failed")
+	do := func(conn *TcpConnection) error {
+		return failed
+	}
+	retryable := func(err error) bool {
+		return true
+	}
+	//预算开始时是满的，只够一次重试
+	client.withRetry("g", do, retryable)
+	client.withRetry("g", do, retryable)
+	stats := client.RetryStats()
+	if stats.Retries != 1 || stats.BudgetExhausted != 2 {
+		t.Errorf("stats = %+v, want 1 retry and 2 exhausted", stats)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := &RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	want := []time.Duration{10, 20, 40, 50, 50}
+	for i, w := range want {
+		if got := retryBackoff(policy, i + 1); got != w * time.Millisecond {
+			t.Errorf("attempt %d: backoff = %v, want %v", i + 1, got, w * time.Millisecond)
+		}
+	}
+}
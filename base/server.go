@@ -16,6 +16,17 @@ type TCPServer struct {
 	Manager   *Manager        		// TcpSession的管理
 	Protocol  protocol.Protocol  	// Protocol -> Make Codec
 	NetworkCB NetworkCallBack 		// TcpConnection callBack
+	Registry  *protocol.TypeRegistry	// SendTyped使用的类型注册表，为nil时使用protocol.DefaultRegistry
+
+	lock      sync.Mutex
+	inbound   *serverInbound   		// 入站限制，见server_limit.go
+	admission *admission       		// 连接数限制，见server_admission.go
+	acl       *aclRules        		// 访问控制，见server_acl.go
+	proxy     *proxyAccept     		// PROXY protocol，见proxyproto.go
+	accepted  chan acceptResult		// 等待中的listener Accept的结果，见nextConn
+	accepting bool
+	aclDenied uint64
+	aclClosed uint64
 	//CryptInfo mls.Info        		// For TLS Config
 }
 
@@ -36,16 +47,73 @@ func NewTCPServer(address string, p protocol.Protocol) (*TCPServer, error) {
 	}, nil
 }
 
+//设置了ACL或者AdmissionPolicy时，不允许或者超过连接数限制的连接在这里处理掉，继续等待下一个连接；
+//设置了AdmissionPolicy时返回的连接占用连接数的名额，Close时释放；ADMIT_QUEUE排队的连接得到名额后也由这里返回
+//设置了ProxyPolicy时返回的连接RemoteAddr为解析头部得到的真实客户端地址，ACL和连接数限制都按这个地址计算
 func (this *TCPServer) Accept() (net.Conn, error) {
-	conn, err := this.listener.Accept()
-	if err != nil {
-		log.Println("TcpServer -> Accept : ", err.Error())
-		return nil, err
-	} else {
-		return conn, err
+	for {
+		conn, admitted, err := this.nextConn()
+		if err != nil {
+			log.Println("TcpServer -> Accept : ", err.Error())
+			return nil, err
+		}
+		if admitted {
+			return conn, nil
+		}
+		if !this.aclPermit(conn) {
+			continue
+		}
+		if conn, admitted = this.admit(conn); admitted {
+			return conn, nil
+		}
+	}
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+//等待新的连接或者排队后得到名额的连接（admitted为true，已经检查过）；
+//新的连接在单独的协程中等待，Accept先返回排队的连接时，等到的新连接留给下一次Accept
+func (this *TCPServer) nextConn() (conn net.Conn, admitted bool, err error) {
+	this.lock.Lock()
+	if this.accepted == nil {
+		this.accepted = make(chan acceptResult, 1)
+	}
+	if !this.accepting {
+		this.accepting = true
+		go func() {
+			defer RecoverPrint()
+			conn, err := this.acceptConn()
+			this.accepted <- acceptResult{conn, err}
+		}()
+	}
+	accepted := this.accepted
+	this.lock.Unlock()
+
+	select {
+	case res := <-accepted:
+		this.lock.Lock()
+		this.accepting = false
+		this.lock.Unlock()
+		return res.conn, false, res.err
+	case conn := <-this.admittedQueue():
+		return conn, true, nil
 	}
 }
 
+//由Accept得到的连接创建TcpConnection，放入Manager并关联入站限制，调用Start后开始收发
+func (this *TCPServer) NewSession(conn net.Conn, networkcb NetworkCallBack) *TcpConnection {
+	//先设置Address再放入Manager，Manager按地址建立索引
+	session := NewServerConn(GetNetId(), this.Protocol.NewCodec(conn), networkcb, nil)
+	session.Address = conn.RemoteAddr().String()
+	session.ConnManager = this.Manager
+	this.Manager.PutSession(session)
+	this.attachInbound(session, conn.RemoteAddr())
+	return session
+}
+
 //根据ConnId发送数据
 func (this *TCPServer) SendData(connId uint64, msg protocol.Message) error {
 	session := this.Manager.GetSession(connId)
@@ -56,6 +124,25 @@ func (this *TCPServer) SendData(connId uint64, msg protocol.Message) error {
 	return session.Write(msg)
 }
 
+//广播给所有（或者opt.Filter选中的）连接，返回每个连接的投递结果
+func (this *TCPServer) Broadcast(msg protocol.Message, opt *BroadcastOption) []BroadcastResult {
+	return this.Manager.Broadcast(msg, opt)
+}
+
+//按Registry中注册的MsgType编码v，然后根据ConnId发送
+func (this *TCPServer) SendTyped(connId uint64, v interface{}) error {
+	registry := this.Registry
+	if registry == nil {
+		registry = protocol.DefaultRegistry
+	}
+
+	msg, err := registry.Encode(v)
+	if err != nil {
+		return err
+	}
+	return this.SendData(connId, msg)
+}
+
 func (this *TCPServer) Stop() {
 	this.listener.Close()
 	this.Manager.Dispose()
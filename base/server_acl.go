@@ -0,0 +1,164 @@
+package base
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+	log "github.com/sotter/dovenet/log"
+)
+
+//按对端IP的访问控制，规则为CIDR（如"10.0.0.0/8"）或者单个IP
+//  - 命中Deny的拒绝
+//  - Allow不为空时，只接受命中Allow的
+type ACL struct {
+	Allow []string
+	Deny  []string
+}
+
+//SetACL更新规则后，不再被允许的连接排空的最长时间
+const aclDrainTimeout = 5 * time.Second
+
+type aclRules struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseCIDRs(rules []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(rules))
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if !strings.Contains(rule, "/") {
+			ip := net.ParseIP(rule)
+			if ip == nil {
+				return nil, fmt.Errorf("ACL : invalid ip %q", rule)
+			}
+			if ip.To4() != nil {
+				rule += "/32"
+			} else {
+				rule += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(rule)
+		if err != nil {
+			return nil, fmt.Errorf("ACL : invalid cidr %q", rule)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+//去掉IPv6地址中的zone（如"fe80::1%eth0"），net.ParseIP不接受带zone的地址
+func parseIP(host string) net.IP {
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+func newACLRules(acl *ACL) (*aclRules, error) {
+	allow, err := parseCIDRs(acl.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(acl.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &aclRules{allow: allow, deny: deny}, nil
+}
+
+func (this *aclRules) permit(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range this.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(this.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range this.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//设置访问控制，运行中可以随时更新，acl为nil时不做限制；规则有错误时不生效并返回错误
+//已有的连接同样按新的规则检查，不再被允许的：closeDenied为true时立即关闭，
+//否则等发送队列中已有的消息写出后关闭（最多等待aclDrainTimeout）
+func (this *TCPServer) SetACL(acl *ACL, closeDenied bool) error {
+	var rules *aclRules
+	if acl != nil {
+		var err error
+		if rules, err = newACLRules(acl); err != nil {
+			return err
+		}
+	}
+
+	this.lock.Lock()
+	this.acl = rules
+	this.lock.Unlock()
+
+	if rules == nil {
+		return nil
+	}
+
+	for _, session := range this.Manager.Sessions() {
+		if session.IsDraining() {
+			continue
+		}
+		host, _, err := net.SplitHostPort(session.Address)
+		if err != nil {
+			continue
+		}
+		if rules.permit(parseIP(host)) {
+			continue
+		}
+
+		log.Println("TcpServer -> ACL close ", session.String())
+		atomic.AddUint64(&this.aclClosed, 1)
+		if closeDenied {
+			session.Close()
+		} else {
+			session.startDrain()
+			go session.Drain(aclDrainTimeout)
+		}
+	}
+	return nil
+}
+
+//被访问控制拒绝的新连接数
+func (this *TCPServer) ACLDenied() uint64 {
+	return atomic.LoadUint64(&this.aclDenied)
+}
+
+//规则更新后被关闭（包括排空后关闭）的已有连接数
+func (this *TCPServer) ACLClosed() uint64 {
+	return atomic.LoadUint64(&this.aclClosed)
+}
+
+//检查新的连接，不允许时关闭连接并返回false
+func (this *TCPServer) aclPermit(conn net.Conn) bool {
+	this.lock.Lock()
+	rules := this.acl
+	this.lock.Unlock()
+
+	if rules == nil {
+		return true
+	}
+	if rules.permit(parseIP(remoteIP(conn.RemoteAddr()))) {
+		return true
+	}
+
+	log.Println("TcpServer -> ACL deny ", conn.RemoteAddr().String())
+	atomic.AddUint64(&this.aclDenied, 1)
+	conn.Close()
+	return false
+}
@@ -0,0 +1,99 @@
+package base
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		want  []string
+		ok    bool
+	}{
+		{"empty", nil, []string{}, true},
+		{"ipv4 cidr", []string{"10.0.0.0/8"}, []string{"10.0.0.0/8"}, true},
+		{"ipv4 host", []string{"1.2.3.4"}, []string{"1.2.3.4/32"}, true},
+		{"ipv6 host", []string{"2001:db8::1"}, []string{"2001:db8::1/128"}, true},
+		{"ipv6 cidr", []string{"fe80::/10"}, []string{"fe80::/10"}, true},
+		{"host bits masked", []string{"192.168.1.77/24"}, []string{"192.168.1.0/24"}, true},
+		{"spaces", []string{" 10.0.0.1 "}, []string{"10.0.0.1/32"}, true},
+		{"match all", []string{"0.0.0.0/0"}, []string{"0.0.0.0/0"}, true},
+		{"bad ip", []string{"10.0.0.256"}, nil, false},
+		{"bad prefix", []string{"10.0.0.0/33"}, nil, false},
+		{"hostname", []string{"localhost"}, nil, false},
+		{"one bad rule", []string{"10.0.0.0/8", "bad"}, nil, false},
+	}
+
+	for _, test := range tests {
+		nets, err := parseCIDRs(test.rules)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: err = %v, want ok %v", test.name, err, test.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(nets) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, nets, test.want)
+			continue
+		}
+		for i, ipNet := range nets {
+			if ipNet.String() != test.want[i] {
+				t.Errorf("%s: rule %d = %s, want %s", test.name, i, ipNet, test.want[i])
+			}
+		}
+	}
+}
+
+func TestACLPermit(t *testing.T) {
+	tests := []struct {
+		name string
+		acl  ACL
+		ip   string
+		want bool
+	}{
+		{"no rules", ACL{}, "1.2.3.4", true},
+		{"denied", ACL{Deny: []string{"10.0.0.0/8"}}, "10.1.2.3", false},
+		{"not denied", ACL{Deny: []string{"10.0.0.0/8"}}, "11.1.2.3", true},
+		{"allowed", ACL{Allow: []string{"192.168.0.0/16"}}, "192.168.3.4", true},
+		{"not allowed", ACL{Allow: []string{"192.168.0.0/16"}}, "192.169.3.4", false},
+		{"deny wins", ACL{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}}, "10.0.0.1", false},
+		{"allow with deny", ACL{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}}, "10.0.0.2", true},
+		{"ipv4 mapped ipv6", ACL{Allow: []string{"10.0.0.0/8"}}, "::ffff:10.0.0.1", true},
+		{"ipv6 not in ipv4 rule", ACL{Allow: []string{"10.0.0.0/8"}}, "2001:db8::1", false},
+		{"zoned ipv6", ACL{Allow: []string{"fe80::/10"}}, "fe80::1%eth0", true},
+		{"zoned ipv6 denied", ACL{Deny: []string{"fe80::1"}}, "fe80::1%eth0", false},
+		{"invalid ip", ACL{}, "not-an-ip", false},
+	}
+
+	for _, test := range tests {
+		rules, err := newACLRules(&test.acl)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := rules.permit(parseIP(test.ip)); got != test.want {
+			t.Errorf("%s: permit(%s) = %v, want %v", test.name, test.ip, got, test.want)
+		}
+	}
+}
+
+func TestParseIPZone(t *testing.T) {
+	tests := []struct {
+		host string
+		want net.IP
+	}{
+		{"1.2.3.4", net.ParseIP("1.2.3.4")},
+		{"fe80::1%eth0", net.ParseIP("fe80::1")},
+		{"fe80::1%", net.ParseIP("fe80::1")},
+		{"%eth0", nil},
+	}
+
+	for _, test := range tests {
+		if got := parseIP(test.host); !got.Equal(test.want) {
+			t.Errorf("parseIP(%q) = %v, want %v", test.host, got, test.want)
+		}
+	}
+}
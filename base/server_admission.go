@@ -0,0 +1,236 @@
+package base
+
+import (
+	"net"
+	"sync"
+	"time"
+	"github.com/sotter/dovenet/protocol"
+	log "github.com/sotter/dovenet/log"
+)
+
+//连接数超过限制时的处理方式
+const (
+	ADMIT_REJECT = iota // 直接关闭
+	ADMIT_BUSY          // 协议实现了protocol.BusyProtocol时先发服务繁忙的消息再关闭，否则直接关闭
+	ADMIT_QUEUE         // 等待已有的连接关闭，最多QueueTimeout，超时后直接关闭
+)
+
+//等待服务繁忙的消息发出的最长时间
+var busyWriteTimeout = time.Second
+
+//TCPServer的连接数限制，在Accept中检查
+//  - MaxConnections为总的连接数，默认MAX_CONNECTIONS；MaxPerIP为同一个对端IP的连接数，0表示不限制
+//  - ADMIT_QUEUE只对总的连接数生效，排队的连接在单独的协程中等待，不影响Accept接受其他连接，
+//    等到名额后由Accept返回；超过MaxPerIP的连接总是按ADMIT_REJECT处理，避免一个IP挡住其他IP
+//  - 占用名额的连接在关闭时释放名额，不管是否经过NewSession
+type AdmissionPolicy struct {
+	MaxConnections int
+	MaxPerIP       int
+	Mode           int
+	QueueTimeout   time.Duration
+}
+
+//连接数限制的统计
+type AdmissionStats struct {
+	Active        int    // 当前的连接数
+	Rejected      uint64 // 直接关闭的连接数
+	Busy          uint64 // 发送了服务繁忙消息的连接数
+	Queued        uint64 // 等待过的连接数
+	QueueTimeouts uint64 // 等待超时的连接数
+}
+
+type admission struct {
+	policy AdmissionPolicy
+
+	lock   sync.Mutex
+	active int
+	perIP  map[string]int
+	freed  chan struct{}  // 有连接关闭时close并重新创建，通知排队的连接
+	ready  chan net.Conn  // 排队后得到名额的连接，交给Accept
+	stats  AdmissionStats
+}
+
+//占用了连接数名额的连接，Close时释放名额
+type admittedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (this *admittedConn) Close() error {
+	this.once.Do(this.release)
+	return this.Conn.Close()
+}
+
+//设置连接数限制，policy为nil时取消限制；已有的连接不受影响，但只有之后Accept的连接会被计数
+func (this *TCPServer) SetAdmissionPolicy(policy *AdmissionPolicy) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if policy == nil {
+		this.admission = nil
+		return
+	}
+
+	p := *policy
+	if p.MaxConnections <= 0 {
+		p.MaxConnections = MAX_CONNECTIONS
+	}
+	this.admission = &admission{
+		policy: p,
+		perIP:  make(map[string]int),
+		freed:  make(chan struct{}),
+		ready:  make(chan net.Conn),
+	}
+}
+
+func (this *TCPServer) AdmissionStats() AdmissionStats {
+	this.lock.Lock()
+	adm := this.admission
+	this.lock.Unlock()
+
+	if adm == nil {
+		return AdmissionStats{}
+	}
+	adm.lock.Lock()
+	defer adm.lock.Unlock()
+	stats := adm.stats
+	stats.Active = adm.active
+	return stats
+}
+
+//排队后得到名额的连接，没有设置AdmissionPolicy时为nil
+func (this *TCPServer) admittedQueue() chan net.Conn {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.admission == nil {
+		return nil
+	}
+	return this.admission.ready
+}
+
+//检查新的连接，返回true时conn换成占用名额的连接；返回false时连接已经被处理（关闭、发送繁忙消息后关闭或者开始排队）
+func (this *TCPServer) admit(conn net.Conn) (net.Conn, bool) {
+	this.lock.Lock()
+	adm := this.admission
+	this.lock.Unlock()
+
+	if adm == nil {
+		return conn, true
+	}
+
+	ip := remoteIP(conn.RemoteAddr())
+	adm.lock.Lock()
+	if adm.policy.MaxPerIP > 0 && adm.perIP[ip] >= adm.policy.MaxPerIP {
+		adm.lock.Unlock()
+		log.Println("TcpServer -> too many connections from ", ip)
+		this.reject(adm, conn, ADMIT_REJECT)
+		return nil, false
+	}
+	if adm.active < adm.policy.MaxConnections {
+		admitted := adm.acquireLocked(conn, ip)
+		adm.lock.Unlock()
+		return admitted, true
+	}
+	if adm.policy.Mode != ADMIT_QUEUE {
+		adm.lock.Unlock()
+		log.Println("TcpServer -> too many connections, reject ", conn.RemoteAddr().String())
+		this.reject(adm, conn, adm.policy.Mode)
+		return nil, false
+	}
+	adm.stats.Queued++
+	adm.lock.Unlock()
+
+	go this.queue(adm, conn, ip)
+	return nil, false
+}
+
+//排队等待其他连接关闭，得到名额后交给Accept；QueueTimeout内没有得到名额或者没有被Accept取走时关闭
+func (this *TCPServer) queue(adm *admission, conn net.Conn, ip string) {
+	defer RecoverPrint()
+
+	timer := time.NewTimer(adm.policy.QueueTimeout)
+	defer timer.Stop()
+
+	for {
+		adm.lock.Lock()
+		if adm.active < adm.policy.MaxConnections {
+			admitted := adm.acquireLocked(conn, ip)
+			adm.lock.Unlock()
+
+			select {
+			case adm.ready <- admitted:
+			case <-timer.C:
+				adm.addStat(&adm.stats.QueueTimeouts)
+				admitted.Close()
+			}
+			return
+		}
+		freed := adm.freed
+		adm.lock.Unlock()
+
+		select {
+		case <-freed:
+		case <-timer.C:
+			adm.addStat(&adm.stats.QueueTimeouts)
+			this.reject(adm, conn, ADMIT_REJECT)
+			return
+		}
+	}
+}
+
+//占用一个名额，调用时持有lock
+func (this *admission) acquireLocked(conn net.Conn, ip string) net.Conn {
+	this.active++
+	this.perIP[ip]++
+	return &admittedConn{
+		Conn: conn,
+		release: func() {
+			this.release(ip)
+		},
+	}
+}
+
+func (this *TCPServer) reject(adm *admission, conn net.Conn, mode int) {
+	busy, ok := this.Protocol.(protocol.BusyProtocol)
+	if mode != ADMIT_BUSY || !ok {
+		adm.addStat(&adm.stats.Rejected)
+		conn.Close()
+		return
+	}
+
+	//在单独的协程中发送，不影响Accept
+	adm.addStat(&adm.stats.Busy)
+	go func() {
+		defer RecoverPrint()
+		defer conn.Close()
+		conn.SetWriteDeadline(time.Now().Add(busyWriteTimeout))
+		if _, err := this.Protocol.NewCodec(conn).Write(busy.BusyMessage()); err != nil {
+			log.Println("TcpServer -> write busy message ", err.Error())
+		}
+	}()
+}
+
+func (this *admission) addStat(stat *uint64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	*stat++
+}
+
+func (this *admission) release(ip string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.active--
+	if this.perIP[ip]--; this.perIP[ip] <= 0 {
+		delete(this.perIP, ip)
+	}
+	close(this.freed)
+	this.freed = make(chan struct{})
+}
+
+//释放Accept返回的连接占用的名额，连接关闭时会自动释放，不需要再调用；可以重复调用
+func (this *TCPServer) Release(conn net.Conn) {
+	if admitted, ok := conn.(*admittedConn); ok {
+		admitted.once.Do(admitted.release)
+	}
+}
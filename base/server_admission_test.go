@@ -0,0 +1,127 @@
+package base
+
+import (
+	"net"
+	"testing"
+	"time"
+	"github.com/sotter/dovenet/protocol"
+)
+
+type acceptReturn struct {
+	conn net.Conn
+	err  error
+}
+
+func newAdmissionServer(t *testing.T, policy *AdmissionPolicy) (*TCPServer, chan acceptReturn) {
+	server, err := NewTCPServer("127.0.0.1:0", &protocol.CommProtocol{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetAdmissionPolicy(policy)
+
+	accepted := make(chan acceptReturn, 8)
+	go func() {
+		for {
+			conn, err := server.Accept()
+			accepted <- acceptReturn{conn, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return server, accepted
+}
+
+func dialServer(t *testing.T, server *TCPServer) net.Conn {
+	conn, err := net.Dial("tcp4", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func waitAccepted(t *testing.T, accepted chan acceptReturn) net.Conn {
+	select {
+	case ret := <-accepted:
+		if ret.err != nil {
+			t.Fatal(ret.err)
+		}
+		return ret.conn
+	case <-time.After(2 * time.Second):
+		t.Fatal("Accept did not return")
+	}
+	return nil
+}
+
+func waitStats(t *testing.T, server *TCPServer, ok func(AdmissionStats) bool) AdmissionStats {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats := server.AdmissionStats()
+		if ok(stats) || time.Now().After(deadline) {
+			return stats
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+//没有经过NewSession的连接关闭时同样释放名额
+func TestAdmissionReleaseOnClose(t *testing.T) {
+	server, accepted := newAdmissionServer(t, &AdmissionPolicy{MaxConnections: 1})
+	defer server.Stop()
+
+	client := dialServer(t, server)
+	defer client.Close()
+	conn := waitAccepted(t, accepted)
+	if stats := server.AdmissionStats(); stats.Active != 1 {
+		t.Fatalf("Active = %d after accept, want 1", stats.Active)
+	}
+
+	conn.Close()
+	conn.Close()
+	server.Release(conn)
+	if stats := server.AdmissionStats(); stats.Active != 0 {
+		t.Fatalf("Active = %d after close, want 0", stats.Active)
+	}
+}
+
+//排队的连接不影响Accept，等到名额后由Accept返回；等不到名额的超时关闭
+func TestAdmissionQueue(t *testing.T) {
+	server, accepted := newAdmissionServer(t, &AdmissionPolicy{
+		MaxConnections: 1,
+		Mode:           ADMIT_QUEUE,
+		QueueTimeout:   time.Second,
+	})
+	defer server.Stop()
+
+	first := dialServer(t, server)
+	defer first.Close()
+	held := waitAccepted(t, accepted)
+
+	queued := dialServer(t, server)
+	defer queued.Close()
+	stats := waitStats(t, server, func(s AdmissionStats) bool { return s.Queued == 1 })
+	if stats.Queued != 1 {
+		t.Fatalf("Queued = %d, want 1", stats.Queued)
+	}
+
+	//排队期间Accept还在接受新的连接
+	third := dialServer(t, server)
+	defer third.Close()
+	stats = waitStats(t, server, func(s AdmissionStats) bool { return s.Queued == 2 })
+	if stats.Queued != 2 {
+		t.Fatalf("Queued = %d while another conn is waiting, want 2", stats.Queued)
+	}
+
+	held.Close()
+	conn := waitAccepted(t, accepted)
+	if stats := server.AdmissionStats(); stats.Active != 1 {
+		t.Errorf("Active = %d after queued conn admitted, want 1", stats.Active)
+	}
+
+	//剩下的一个等不到名额，超时后关闭
+	stats = waitStats(t, server, func(s AdmissionStats) bool { return s.QueueTimeouts == 1 })
+	if stats.QueueTimeouts != 1 || stats.Active != 1 {
+		t.Errorf("stats %+v, want one queue timeout and one active", stats)
+	}
+	conn.Close()
+}
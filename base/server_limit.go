@@ -0,0 +1,243 @@
+package base
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/sotter/dovenet/protocol"
+	log "github.com/sotter/dovenet/log"
+)
+
+//超过入站限制时的处理方式
+const (
+	INBOUND_DELAY = iota // 暂停读，直到限制允许，对端的发送会被TCP流控挡住
+	INBOUND_DROP         // 丢弃消息，不交给OnMessageData
+	INBOUND_CLOSE        // 关闭连接
+)
+
+//入站的消息速率和字节速率（令牌桶），为0时不限制；字节数按protocol.Sized计算，没有实现Sized的消息不限制字节数
+type InboundLimit struct {
+	MsgRate   float64
+	MsgBurst  int
+	ByteRate  float64
+	ByteBurst int
+}
+
+//服务端的入站限制，对每个连接和每个对端IP（同一IP的所有连接一起）分别计算，
+//在消息交给OnMessageData之前检查，心跳和Request的回应不受限制
+type InboundPolicy struct {
+	PerConn InboundLimit
+	PerIP   InboundLimit
+	Action  int
+}
+
+//入站限制的统计
+type InboundStats struct {
+	Delayed uint64 // 被延迟读的消息数
+	Dropped uint64 // 被丢弃的消息数
+	Closed  uint64 // 被关闭的连接数
+}
+
+type inboundLimiter struct {
+	msgs  *tokenBucket
+	bytes *tokenBucket
+}
+
+//没有任何限制时返回nil
+func newInboundLimiter(limit InboundLimit) *inboundLimiter {
+	if limit.MsgRate <= 0 && limit.ByteRate <= 0 {
+		return nil
+	}
+	limiter := &inboundLimiter{}
+	if limit.MsgRate > 0 {
+		limiter.msgs = newTokenBucket(limit.MsgRate, limit.MsgBurst)
+	}
+	if limit.ByteRate > 0 {
+		limiter.bytes = newTokenBucket(limit.ByteRate, limit.ByteBurst)
+	}
+	return limiter
+}
+
+//返回需要等待的时间，maxWait的含义见tokenBucket.take；被拒绝时不消耗任何一个桶的令牌
+func (this *inboundLimiter) take(size int, maxWait time.Duration) (time.Duration, bool) {
+	var wait time.Duration
+	if this.msgs != nil {
+		w, ok := this.msgs.take(1, maxWait)
+		if !ok {
+			return 0, false
+		}
+		wait = w
+	}
+	if this.bytes != nil && size > 0 {
+		w, ok := this.bytes.take(float64(size), maxWait)
+		if !ok {
+			if this.msgs != nil {
+				this.msgs.refund(1)
+			}
+			return 0, false
+		}
+		if w > wait {
+			wait = w
+		}
+	}
+	return wait, true
+}
+
+//退回take取走的令牌
+func (this *inboundLimiter) refund(size int) {
+	if this.msgs != nil {
+		this.msgs.refund(1)
+	}
+	if this.bytes != nil && size > 0 {
+		this.bytes.refund(float64(size))
+	}
+}
+
+//同一个IP的连接共用，最后一个连接关闭时删除
+type ipInbound struct {
+	limiter *inboundLimiter
+	refs    int
+}
+
+type serverInbound struct {
+	policy InboundPolicy
+	lock   sync.Mutex
+	ips    map[string]*ipInbound
+	stats  InboundStats
+}
+
+//连接上的入站限制
+type connInbound struct {
+	server *serverInbound
+	conn   *inboundLimiter
+	ip     *inboundLimiter
+}
+
+//检查一个入站消息，返回false时丢弃；返回error时关闭连接
+func (this *connInbound) admit(msg protocol.Message) (bool, error) {
+	size := 0
+	if sized, ok := msg.(protocol.Sized); ok {
+		size = sized.Size()
+	}
+
+	maxWait := time.Duration(0)
+	if this.server.policy.Action == INBOUND_DELAY {
+		maxWait = -1
+	}
+
+	var wait time.Duration
+	var taken []*inboundLimiter
+	for _, limiter := range []*inboundLimiter{this.conn, this.ip} {
+		if limiter == nil {
+			continue
+		}
+		w, ok := limiter.take(size, maxWait)
+		if !ok {
+			//被拒绝的消息不占用前面已经通过的限制
+			for _, t := range taken {
+				t.refund(size)
+			}
+			if this.server.policy.Action == INBOUND_CLOSE {
+				atomic.AddUint64(&this.server.stats.Closed, 1)
+				return false, ErrorRateLimited
+			}
+			atomic.AddUint64(&this.server.stats.Dropped, 1)
+			return false, nil
+		}
+		taken = append(taken, limiter)
+		if w > wait {
+			wait = w
+		}
+	}
+
+	if wait > 0 {
+		atomic.AddUint64(&this.server.stats.Delayed, 1)
+		time.Sleep(wait)
+	}
+	return true, nil
+}
+
+//设置入站限制，只对之后由NewSession建立的连接生效；policy为nil时取消限制
+func (this *TCPServer) SetInboundPolicy(policy *InboundPolicy) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if policy == nil {
+		this.inbound = nil
+		return
+	}
+	this.inbound = &serverInbound{
+		policy: *policy,
+		ips:    make(map[string]*ipInbound),
+	}
+}
+
+func (this *TCPServer) InboundStats() InboundStats {
+	this.lock.Lock()
+	inbound := this.inbound
+	this.lock.Unlock()
+
+	if inbound == nil {
+		return InboundStats{}
+	}
+	return InboundStats{
+		Delayed: atomic.LoadUint64(&inbound.stats.Delayed),
+		Dropped: atomic.LoadUint64(&inbound.stats.Dropped),
+		Closed:  atomic.LoadUint64(&inbound.stats.Closed),
+	}
+}
+
+//给新连接关联入站限制，同一IP的限制在最后一个连接关闭时释放
+func (this *TCPServer) attachInbound(session *TcpConnection, addr net.Addr) {
+	this.lock.Lock()
+	inbound := this.inbound
+	this.lock.Unlock()
+
+	if inbound == nil {
+		return
+	}
+
+	ci := &connInbound{
+		server: inbound,
+		conn:   newInboundLimiter(inbound.policy.PerConn),
+	}
+
+	ip := remoteIP(addr)
+	if perIP := newInboundLimiter(inbound.policy.PerIP); perIP != nil {
+		inbound.lock.Lock()
+		entry, exist := inbound.ips[ip]
+		if !exist {
+			entry = &ipInbound{limiter: perIP}
+			inbound.ips[ip] = entry
+		}
+		entry.refs++
+		ci.ip = entry.limiter
+		inbound.lock.Unlock()
+
+		session.AddCloseHook(func() {
+			inbound.lock.Lock()
+			defer inbound.lock.Unlock()
+			if entry.refs--; entry.refs <= 0 {
+				delete(inbound.ips, ip)
+			}
+		})
+	}
+
+	if ci.conn == nil && ci.ip == nil {
+		return
+	}
+	session.inbound = ci
+}
+
+//对端的IP，不是TCP地址时返回整个地址
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		log.Println("remoteIP -> ", addr.String(), " : ", err.Error())
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,42 @@
+package base
+
+import (
+	"testing"
+
+	"github.com/sotter/dovenet/protocol"
+)
+
+//同一IP的限制拒绝时，按动作丢弃或者关闭，并且退回连接上已经取走的令牌
+func TestInboundAdmit(t *testing.T) {
+	tests := []struct {
+		name   string
+		action int
+		err    error
+		stats  InboundStats
+	}{
+		{"drop", INBOUND_DROP, nil, InboundStats{Dropped: 1}},
+		{"close", INBOUND_CLOSE, ErrorRateLimited, InboundStats{Closed: 1}},
+	}
+
+	for _, test := range tests {
+		server := &serverInbound{policy: InboundPolicy{Action: test.action}}
+		ip := newInboundLimiter(InboundLimit{MsgRate: 1, MsgBurst: 1})
+		first := &connInbound{server: server, conn: newInboundLimiter(InboundLimit{MsgRate: 1, MsgBurst: 2}), ip: ip}
+		second := &connInbound{server: server, conn: newInboundLimiter(InboundLimit{MsgRate: 1, MsgBurst: 2}), ip: ip}
+		msg := protocol.NewCommMsg(1, nil)
+
+		if ok, err := first.admit(msg); !ok || err != nil {
+			t.Fatalf("%s: first message = %v, %v", test.name, ok, err)
+		}
+		ok, err := second.admit(msg)
+		if ok || err != test.err {
+			t.Errorf("%s: message over the IP limit = %v, %v, want false, %v", test.name, ok, err, test.err)
+		}
+		if second.conn.msgs.tokens != 2 {
+			t.Errorf("%s: conn tokens = %v after IP rejection, want refunded to 2", test.name, second.conn.msgs.tokens)
+		}
+		if server.stats != test.stats {
+			t.Errorf("%s: stats %+v, want %+v", test.name, server.stats, test.stats)
+		}
+	}
+}
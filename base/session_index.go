@@ -0,0 +1,159 @@
+package base
+
+import (
+	"sync"
+	"github.com/sotter/dovenet/protocol"
+)
+
+//key到连接的二级索引，一个key可以对应多个连接，一个连接也可以有多个key；
+//Manager的标签、分组、对端地址以及PubSub的订阅都使用这个索引
+type sessionIndex struct {
+	sync.RWMutex
+	sessions map[string]map[uint64]*TcpConnection
+	keys     map[uint64]map[string]struct{}
+}
+
+func newSessionIndex() *sessionIndex {
+	return &sessionIndex{
+		sessions: make(map[string]map[uint64]*TcpConnection),
+		keys:     make(map[uint64]map[string]struct{}),
+	}
+}
+
+func (this *sessionIndex) add(key string, conn *TcpConnection) {
+	this.Lock()
+	defer this.Unlock()
+
+	conns, exist := this.sessions[key]
+	if !exist {
+		conns = make(map[uint64]*TcpConnection)
+		this.sessions[key] = conns
+	}
+	conns[conn.ConnID] = conn
+
+	keys, exist := this.keys[conn.ConnID]
+	if !exist {
+		keys = make(map[string]struct{})
+		this.keys[conn.ConnID] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (this *sessionIndex) remove(key string, connId uint64) {
+	this.Lock()
+	defer this.Unlock()
+	this.removeLocked(key, connId)
+}
+
+func (this *sessionIndex) removeLocked(key string, connId uint64) {
+	if conns, exist := this.sessions[key]; exist {
+		delete(conns, connId)
+		if len(conns) == 0 {
+			delete(this.sessions, key)
+		}
+	}
+	if keys, exist := this.keys[connId]; exist {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(this.keys, connId)
+		}
+	}
+}
+
+//连接关闭时删除它的所有key
+func (this *sessionIndex) removeConn(connId uint64) {
+	this.Lock()
+	defer this.Unlock()
+	for key := range this.keys[connId] {
+		this.removeLocked(key, connId)
+	}
+}
+
+func (this *sessionIndex) get(key string) []*TcpConnection {
+	this.RLock()
+	defer this.RUnlock()
+
+	conns := make([]*TcpConnection, 0, len(this.sessions[key]))
+	for _, conn := range this.sessions[key] {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (this *sessionIndex) keysOf(connId uint64) []string {
+	this.RLock()
+	defer this.RUnlock()
+
+	keys := make([]string, 0, len(this.keys[connId]))
+	for key := range this.keys[connId] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (this *sessionIndex) count(key string) int {
+	this.RLock()
+	defer this.RUnlock()
+	return len(this.sessions[key])
+}
+
+//加入索引之后再检查一次连接状态：Close先把running置为0再从Manager中删除，
+//所以要么delSession能看到这次加入，要么这里能看到连接已经关闭
+func (this *Manager) addIndex(index *sessionIndex, key string, conn *TcpConnection) error {
+	if this.GetSession(conn.ConnID) != conn {
+		return ErrorParameter
+	}
+
+	index.add(key, conn)
+	if conn.IsClosed() {
+		index.remove(key, conn.ConnID)
+		return ErrorConnClosed
+	}
+	return nil
+}
+
+//给连接打上标签，如"uid:10086"，一个标签可以对应多个连接（同一个用户的多端登录）
+func (this *Manager) Tag(conn *TcpConnection, tag string) error {
+	return this.addIndex(this.tags, tag, conn)
+}
+
+func (this *Manager) Untag(conn *TcpConnection, tag string) {
+	this.tags.remove(tag, conn.ConnID)
+}
+
+func (this *Manager) Tags(conn *TcpConnection) []string {
+	return this.tags.keysOf(conn.ConnID)
+}
+
+func (this *Manager) GetSessionsByTag(tag string) []*TcpConnection {
+	return this.tags.get(tag)
+}
+
+func (this *Manager) BroadcastTag(tag string, msg protocol.Message, opt *BroadcastOption) []BroadcastResult {
+	return broadcast(this.tags.get(tag), msg, opt)
+}
+
+//加入分组，如房间、频道，连接关闭时自动退出所有分组
+func (this *Manager) Join(group string, conn *TcpConnection) error {
+	return this.addIndex(this.groups, group, conn)
+}
+
+func (this *Manager) Leave(group string, conn *TcpConnection) {
+	this.groups.remove(group, conn.ConnID)
+}
+
+func (this *Manager) Groups(conn *TcpConnection) []string {
+	return this.groups.keysOf(conn.ConnID)
+}
+
+func (this *Manager) GetGroupSessions(group string) []*TcpConnection {
+	return this.groups.get(group)
+}
+
+func (this *Manager) GroupSize(group string) int {
+	return this.groups.count(group)
+}
+
+func (this *Manager) BroadcastGroup(group string, msg protocol.Message, opt *BroadcastOption) []BroadcastResult {
+	return broadcast(this.groups.get(group), msg, opt)
+}
@@ -50,12 +50,37 @@ type TcpConnection struct {
 
 	ConnManager        *Manager
 	running            int32
+	draining           int32   // 正在排空，不再被选中发送新的消息
 	once               sync.Once
 	finish             sync.WaitGroup
 
 	HeartBeat          bool
 	heartBeatInterval  time.Duration
 
+	//心跳的RTT计算，都是UnixNano，用atomic访问
+	pingTime           int64   // 最近一次未收到回应的心跳请求的发送时间
+	pongTime           int64   // 最近一次收到心跳回应的时间
+	rtt                int64
+
+	//健康检查的状态，见health.go
+	health             connHealth
+	breaker            atomic.Value // *Breaker，见breaker.go
+	lastWrite          int64        // 最近一次发送业务数据（不包括心跳）的时间，UnixNano，用于连接池回收空闲连接
+
+	//服务端的入站限制，见server_limit.go
+	inbound            *connInbound
+
+	//连接关闭时调用，用于释放和连接关联的资源
+	hookLock           sync.Mutex
+	closeHooks         []func()
+	hooksDone          bool
+
+	//等待回应的请求，见request.go
+	seq                uint32
+	pendingLock        sync.Mutex
+	pending            map[uint32]*pendingCall
+	callsDone          chan struct{} // 等待回应的请求全部结束时通知，用于Drain
+
 	//异步数据发送队列
 	messageSendChan    chan protocol.Message
 	messageHandlerChan chan protocol.Message
@@ -92,6 +117,7 @@ func NewServerConn(connid uint64, conn protocol.Conn, networkcb NetworkCallBack,
 		messageSendChan: make(chan protocol.Message, 128),
 		messageHandlerChan: make(chan protocol.Message, 128),
 		closeConnChan: make(chan struct{}),
+		callsDone: make(chan struct{}, 1),
 
 		NetworkCB: networkcb,
 		Reconnect : false,
@@ -124,12 +150,25 @@ func NewClientConn(connId uint64, conn protocol.Conn, chanSize uint32, networkcb
 		messageSendChan: make(chan protocol.Message, chanSize),
 		messageHandlerChan: make(chan protocol.Message, chanSize),
 		closeConnChan: make(chan struct{}),
+		callsDone: make(chan struct{}, 1),
 		NetworkCB: networkcb,
 		WorkNum : 16,
 		Reconnect : true,
 	}
 }
 
+//心跳消息，由writeLoop拆开后再交给Codec
+type heartBeatMsg struct {
+	protocol.Message
+}
+
+//Drain放在发送队列最后的标记，writeLoop取到时前面的消息都已经写出，关闭连接
+type drainMsg struct{}
+
+func (this drainMsg) Serialize() ([]byte, error) {
+	return nil, nil
+}
+
 //记录当前TcpConnection的信息
 func (this *TcpConnection)String() string {
 	return fmt.Sprint(this.ConnID , ":",  this.Address)
@@ -155,34 +194,204 @@ func (this *TcpConnection)Stop() bool {
 	return true
 }
 
+//设置心跳间隔，在Start之前调用，interval为0时不主动发送心跳
+func (this *TcpConnection) SetHeartBeatInterval(interval time.Duration) {
+	this.heartBeatInterval = interval
+	this.HeartBeat = interval > 0
+}
+
+//主动发送一次心跳，和普通消息一样经过发送队列
 func (this *TcpConnection) DoHeartBeat() error {
-	return this.conn.DoHeartBeat()
+	msg := this.conn.NewHeartBeat()
+	if msg == nil {
+		return nil
+	}
+
+	//上一个心跳还没有回应时保留原来的时间，RTT按最早的那个请求计算
+	atomic.CompareAndSwapInt64(&this.pingTime, 0, time.Now().UnixNano())
+	return this.Write(heartBeatMsg{msg})
 }
 
-func (this *TcpConnection)Write(msg protocol.Message) (err error) {
+//最近一次心跳的往返时间，还没有收到过回应时为0
+func (this *TcpConnection) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.rtt))
+}
+
+//最近一次收到心跳回应的时间
+func (this *TcpConnection) LastPongTime() time.Time {
+	pong := atomic.LoadInt64(&this.pongTime)
+	if pong == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, pong)
+}
+
+func (this *TcpConnection) onHeartBeat(hb *protocol.HeartBeat) {
+	if hb.Ping {
+		if hb.Reply != nil {
+			this.Write(heartBeatMsg{hb.Reply})
+		}
+		return
+	}
+
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&this.pongTime, now)
+	if ping := atomic.SwapInt64(&this.pingTime, 0); ping != 0 {
+		atomic.StoreInt64(&this.rtt, now - ping)
+	}
+}
+
+func (this *TcpConnection)IsClosed() bool {
+	return atomic.LoadInt32(&this.running) == 0
+}
+
+func (this *TcpConnection)IsDraining() bool {
+	return atomic.LoadInt32(&this.draining) == 1
+}
+
+//能否被选中发送新的消息，排除正在排空、被健康检查摘除和熔断中的
+func (this *TcpConnection)Available() bool {
+	return !this.IsClosed() && !this.IsDraining() && !this.Ejected() && this.breakerAllowing()
+}
+
+//发送队列中等待的消息数
+func (this *TcpConnection)QueueLen() int {
+	return len(this.messageSendChan)
+}
+
+func (this *TcpConnection) startDrain() {
+	atomic.StoreInt32(&this.draining, 1)
+}
+
+//不再接受新的消息，等未回应的请求结束、发送队列中的消息写出后关闭，最多等待timeout
+func (this *TcpConnection)Drain(timeout time.Duration) {
+	this.startDrain()
+
+	deadline := time.Now().Add(timeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	defer this.Close()
+
+	for this.PendingCalls() > 0 {
+		select {
+		case <-this.callsDone:
+		case <-this.closeConnChan:
+			return
+		case <-timer.C:
+			return
+		}
+	}
+
+	//标记排在已有的消息后面，由writeLoop写完前面的消息后关闭连接
+	if this.TryWriteTimeout(drainMsg{}, time.Until(deadline)) != DELIVERY_SENT {
+		return
+	}
 	select {
-	case this.messageSendChan <- msg:
-		return nil
-	default:
+	case <-this.closeConnChan:
+	case <-timer.C:
+	}
+}
+
+func (this *TcpConnection)Write(msg protocol.Message) (err error) {
+	switch this.TryWrite(msg) {
+	case DELIVERY_DROPPED:
 		//calc.Add("Lost Packet")
 		log.Println("messageSendChan is full , Write Lost packet !!!")
 		return nil
+	case DELIVERY_CLOSED:
+		return ErrorConnClosed
+	default:
+		return nil
+	}
+}
+
+//不阻塞的放入发送队列，返回投递的结果
+func (this *TcpConnection)TryWrite(msg protocol.Message) (status DeliveryStatus) {
+	//Close时会关闭messageSendChan，和这里的发送存在竞争，向关闭的channel发送会panic
+	defer func() {
+		if recover() != nil {
+			status = DELIVERY_CLOSED
+		}
+	}()
+
+	if this.IsClosed() {
+		return DELIVERY_CLOSED
+	}
+
+	select {
+	case this.messageSendChan <- msg:
+		return DELIVERY_SENT
+	default:
+		return DELIVERY_DROPPED
+	}
+}
+
+//发送队列满时最多等待timeout
+func (this *TcpConnection)TryWriteTimeout(msg protocol.Message, timeout time.Duration) (status DeliveryStatus) {
+	defer func() {
+		if recover() != nil {
+			status = DELIVERY_CLOSED
+		}
+	}()
+
+	if this.IsClosed() {
+		return DELIVERY_CLOSED
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case this.messageSendChan <- msg:
+		return DELIVERY_SENT
+	case <-this.closeConnChan:
+		return DELIVERY_CLOSED
+	case <-timer.C:
+		return DELIVERY_DROPPED
 	}
 }
 
 //TODO : 目前先改成，如果已经发送不出去了，直接把调用者阻塞堵住, 以应对可靠性要求高和具有流控功能的业务
+//连接关闭时返回ErrorConnClosed，调用方据此知道消息没有进入发送队列
 func (this *TcpConnection)WriteWouldBlock(msg protocol.Message) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = ErrorConnClosed
+		}
+	}()
+
+	if this.IsClosed() {
+		return ErrorConnClosed
+	}
+
 	select {
 	case this.messageSendChan <- msg:
 		return nil
 	case <-this.closeConnChan:
 		log.Println("WriteWouldBlock -> To Close ", this.String())
-		return nil
+		return ErrorConnClosed
 	}
 }
 
+//原始字节同样经过发送队列，由writeLoop写出，不会和其他消息交错
+//队列满时返回ErrorWouldBlock，连接关闭时返回ErrorConnClosed，n都为0
 func (this *TcpConnection)WriteBinary(msg []byte) (n int, err error) {
-	return this.conn.WriteBinary(msg)
+	switch this.TryWrite(protocol.RawMsg(msg)) {
+	case DELIVERY_SENT:
+		return len(msg), nil
+	case DELIVERY_DROPPED:
+		log.Println("messageSendChan is full , WriteBinary Lost packet !!!")
+		return 0, ErrorWouldBlock
+	default:
+		return 0, ErrorConnClosed
+	}
+}
+
+func (this *TcpConnection)WriteBinaryWouldBlock(msg []byte) (n int, err error) {
+	if err = this.WriteWouldBlock(protocol.RawMsg(msg)); err != nil {
+		return 0, err
+	}
+	return len(msg), nil
 }
 
 //TODO: 与解包器结合起来；
@@ -194,14 +403,38 @@ func (this *TcpConnection) Read() (err error) {
 		return err
 	}
 
+	if msg == nil {
+		return nil
+	}
+
+	//心跳在读协程中处理掉，回应经过发送队列由writeLoop发出
+	if hb, ok := msg.(*protocol.HeartBeat); ok {
+		this.onHeartBeat(hb)
+		return nil
+	}
+
+	//Request发出的请求的回应直接交给对应的callback
+	if cm, ok := msg.(*protocol.CommMsg); ok && this.completeCall(cm) {
+		return nil
+	}
+
+	//入站限制，超过时延迟读、丢弃或者关闭连接
+	if this.inbound != nil {
+		deliver, err := this.inbound.admit(msg)
+		if err != nil {
+			return err
+		}
+		if !deliver {
+			return nil
+		}
+	}
+
 	select {
 	case this.messageHandlerChan <- msg :
 		return nil
 	case <-this.closeConnChan:
 		return nil
 	}
-
-	return nil
 }
 
 func (this *TcpConnection)readLoop() {
@@ -237,18 +470,56 @@ func (this *TcpConnection)writeLoop() {
 		this.Close()
 	}()
 
+	//需要主动心跳的连接按heartBeatInterval定时发送
+	var heartBeatChan <-chan time.Time
+	if this.HeartBeat && this.heartBeatInterval > 0 {
+		ticker := time.NewTicker(this.heartBeatInterval)
+		defer ticker.Stop()
+		heartBeatChan = ticker.C
+	}
+
 	for atomic.LoadInt32(&this.running) == 1  {
 		select {
 		case <-this.closeConnChan:
 			log.Println("writeLoop -> To Close", this.String())
 			return
 
+		case <-heartBeatChan:
+			this.DoHeartBeat()
+
 		case msg := <-this.messageSendChan:
+			//TransPortClient限制中的消息，写出（或写失败）后才结束请求
+			if _, ok := msg.(drainMsg); ok {
+				log.Println("writeLoop -> Drained", this.String())
+				return
+			}
+			var done func()
+			if tracked, ok := msg.(*trackedMsg); ok {
+				msg = tracked.Message
+				done = tracked.done
+			}
+			//心跳不算作业务数据，不更新lastWrite
+			hb, heartBeat := msg.(heartBeatMsg)
+			if heartBeat {
+				msg = hb.Message
+			}
 			if msg != nil {
-				if _, err := this.conn.Write(msg); err != nil {
+				if _, err := this.conn.Write(msg); err == protocol.ErrorBodyTooLong {
+					//编码失败时什么都没有写出，丢弃这个消息，连接还可以继续使用
 					log.Println("Error writing data ", err.Error(), " ", this.String())
+				} else if err != nil {
+					log.Println("Error writing data ", err.Error(), " ", this.String())
+					if done != nil {
+						done()
+					}
 					return
 				}
+				if !heartBeat {
+					atomic.StoreInt64(&this.lastWrite, time.Now().UnixNano())
+				}
+			}
+			if done != nil {
+				done()
 			}
 		}
 	}
@@ -298,10 +569,43 @@ func (this *TcpConnection)Close() {
 			close(this.messageHandlerChan)
 			close(this.closeConnChan)
 
+			//发送队列中没有写出的消息结束请求，见client_limit.go
+			for msg := range this.messageSendChan {
+				if tracked, ok := msg.(*trackedMsg); ok {
+					tracked.done()
+				}
+			}
+
 			this.conn.Close()
+			this.failPendingCalls()
+			this.runCloseHooks()
 			this.ConnState = CLOSED
 
 			this.finish.Wait()
 		}
 	})
 }
+
+//连接关闭时调用hook，已经关闭时立即调用
+func (this *TcpConnection) AddCloseHook(hook func()) {
+	this.hookLock.Lock()
+	if !this.hooksDone {
+		this.closeHooks = append(this.closeHooks, hook)
+		this.hookLock.Unlock()
+		return
+	}
+	this.hookLock.Unlock()
+	hook()
+}
+
+func (this *TcpConnection) runCloseHooks() {
+	this.hookLock.Lock()
+	hooks := this.closeHooks
+	this.closeHooks = nil
+	this.hooksDone = true
+	this.hookLock.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+}
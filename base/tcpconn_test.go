@@ -0,0 +1,41 @@
+package base
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sotter/dovenet/protocol"
+)
+
+//只记录回调，不做业务处理
+type nopCallBack struct{}
+
+func (this nopCallBack) OnMessageData(conn *TcpConnection, msg protocol.Message) error {
+	return nil
+}
+
+func (this nopCallBack) OnConnection(conn *TcpConnection) {}
+
+func (this nopCallBack) OnDisConnection(conn *TcpConnection) {}
+
+func TestWriteBinaryStatus(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := NewClientConn(1, protocol.NewCommCodec(client, nil), 1, nopCallBack{})
+
+	if n, err := conn.WriteBinary([]byte("abc")); n != 3 || err != nil {
+		t.Errorf("WriteBinary = %d, %v, want 3, nil", n, err)
+	}
+	//发送队列已满
+	if n, err := conn.WriteBinary([]byte("abc")); n != 0 || err != ErrorWouldBlock {
+		t.Errorf("WriteBinary full = %d, %v, want 0, ErrorWouldBlock", n, err)
+	}
+
+	conn.Close()
+	if n, err := conn.WriteBinary([]byte("abc")); n != 0 || err != ErrorConnClosed {
+		t.Errorf("WriteBinary closed = %d, %v, want 0, ErrorConnClosed", n, err)
+	}
+	if n, err := conn.WriteBinaryWouldBlock([]byte("abc")); n != 0 || err != ErrorConnClosed {
+		t.Errorf("WriteBinaryWouldBlock closed = %d, %v, want 0, ErrorConnClosed", n, err)
+	}
+}
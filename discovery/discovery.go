@@ -0,0 +1,150 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"github.com/sotter/dovenet/base"
+	log "github.com/sotter/dovenet/log"
+)
+
+//服务发现的数据源，返回 组名 -> 后端地址列表
+//部分组获取失败时返回其他组的结果和*PartialError
+type Resolver interface {
+	Resolve() (map[string][]string, error)
+}
+
+//部分组获取失败，Failed为 组名 -> 错误
+type PartialError struct {
+	Failed map[string]error
+}
+
+func (this *PartialError) Error() string {
+	names := make([]string, 0, len(this.Failed))
+	for name := range this.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	buffer.WriteString("Resolve failed :")
+	for _, name := range names {
+		fmt.Fprintf(&buffer, " %s(%s)", name, this.Failed[name].Error())
+	}
+	return buffer.String()
+}
+
+//定时从Resolver拉取最新的地址，应用到TransPortClient的成员中
+//Resolver返回错误时保持当前的成员不变，返回*PartialError时只有失败的组保持不变；
+//某个组从结果中消失（并且不是获取失败）时，删除这个组的所有成员
+type Watcher struct {
+	Resolver Resolver
+	Client   *base.TransPortClient
+	Interval time.Duration
+
+	//组的成员发生变化时回调，可以为nil
+	OnChange func(name string, addresses []string)
+
+	lock    sync.Mutex
+	applied map[string][]string
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func NewWatcher(resolver Resolver, client *base.TransPortClient, interval time.Duration) *Watcher {
+	return &Watcher{
+		Resolver: resolver,
+		Client:   client,
+		Interval: interval,
+		applied:  make(map[string][]string),
+		stop:     make(chan struct{}),
+	}
+}
+
+//先同步拉取一次，然后按Interval定时拉取
+func (this *Watcher) Start() error {
+	err := this.Refresh()
+	go this.loop()
+	return err
+}
+
+func (this *Watcher) Stop() {
+	this.once.Do(func() {
+		close(this.stop)
+	})
+}
+
+func (this *Watcher) loop() {
+	defer base.RecoverPrint()
+
+	ticker := time.NewTicker(this.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			if err := this.Refresh(); err != nil {
+				log.Println("Watcher Refresh : ", err.Error())
+			}
+		}
+	}
+}
+
+func sameAddresses(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//立即拉取一次并应用
+func (this *Watcher) Refresh() error {
+	groups, err := this.Resolver.Resolve()
+	partial, isPartial := err.(*PartialError)
+	if err != nil && !isPartial {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for name, addresses := range groups {
+		sorted := append([]string(nil), addresses...)
+		sort.Strings(sorted)
+		if old, exist := this.applied[name]; exist && sameAddresses(old, sorted) {
+			continue
+		}
+
+		log.Println("Watcher -> ", name, " ", sorted)
+		this.Client.SetAddresses(name, sorted)
+		this.applied[name] = sorted
+		if this.OnChange != nil {
+			this.OnChange(name, sorted)
+		}
+	}
+
+	for name := range this.applied {
+		if isPartial && partial.Failed[name] != nil {
+			continue
+		}
+		if _, exist := groups[name]; !exist {
+			log.Println("Watcher -> ", name, " removed")
+			this.Client.SetAddresses(name, nil)
+			delete(this.applied, name)
+			if this.OnChange != nil {
+				this.OnChange(name, nil)
+			}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,69 @@
+package discovery
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sotter/dovenet/base"
+)
+
+//按顺序返回预先设置的结果
+type stubResolver struct {
+	groups []map[string][]string
+	errs   []error
+}
+
+func (this *stubResolver) Resolve() (map[string][]string, error) {
+	groups, err := this.groups[0], this.errs[0]
+	this.groups, this.errs = this.groups[1:], this.errs[1:]
+	return groups, err
+}
+
+//解析失败的组保持原来的成员，从结果中消失的组删除成员
+func TestWatcherPartialFailure(t *testing.T) {
+	failed := errors.New("timeout")
+	resolver := &stubResolver{
+		groups: []map[string][]string{
+			{"a": {"127.0.0.1:1"}, "b": {"127.0.0.1:2"}, "c": {"127.0.0.1:3"}},
+			{"a": {"127.0.0.1:4"}},
+			nil,
+		},
+		errs: []error{
+			nil,
+			&PartialError{Failed: map[string]error{"b": failed}},
+			failed,
+		},
+	}
+
+	client := base.NewTransPortClient()
+	client.ReconnectInterval = time.Hour
+	defer client.Stop()
+	watcher := NewWatcher(resolver, client, time.Hour)
+
+	check := func(step string, want map[string][]string) {
+		for name, addresses := range want {
+			got := client.Addresses(name)
+			sort.Strings(got)
+			if !sameAddresses(got, addresses) {
+				t.Errorf("%s: %s = %v, want %v", step, name, got, addresses)
+			}
+		}
+	}
+
+	if err := watcher.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	check("first", map[string][]string{"a": {"127.0.0.1:1"}, "b": {"127.0.0.1:2"}, "c": {"127.0.0.1:3"}})
+
+	if _, ok := watcher.Refresh().(*PartialError); !ok {
+		t.Errorf("partial refresh did not report the failed group")
+	}
+	check("partial", map[string][]string{"a": {"127.0.0.1:4"}, "b": {"127.0.0.1:2"}, "c": {}})
+
+	if err := watcher.Refresh(); err != failed {
+		t.Errorf("err = %v, want %v", err, failed)
+	}
+	check("failed", map[string][]string{"a": {"127.0.0.1:4"}, "b": {"127.0.0.1:2"}, "c": {}})
+}
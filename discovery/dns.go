@@ -0,0 +1,138 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	log "github.com/sotter/dovenet/log"
+)
+
+//通过DNS解析组的地址，配合Watcher定时重新解析，部署时记录的变化会自动同步到组成员
+//Targets 为 组名 -> DNS名：
+//  "_logic._tcp.example.com"   以"_"开头的按SRV解析，每条记录的target再解析成IP，地址为 ip:port
+//  "logic.example.com:8000"    按A/AAAA解析，地址为 ip:8000
+//某个组解析失败（包括记录不存在NXDOMAIN）时不在结果中，通过*PartialError报告，Watcher保持这个组的成员不变
+type DNSResolver struct {
+	Targets map[string]string
+	Server  string        // DNS服务器地址，如"127.0.0.1:53"，为空时使用系统的配置
+	Timeout time.Duration // 每个组解析的超时，默认3s
+
+	lock    sync.Mutex
+}
+
+func NewDNSResolver(targets map[string]string, server string) *DNSResolver {
+	return &DNSResolver{
+		Targets: targets,
+		Server:  server,
+		Timeout: 3 * time.Second,
+	}
+}
+
+//按Server字段选择DNS服务器
+func (this *DNSResolver) netResolver() *net.Resolver {
+	server := this.Server
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+func (this *DNSResolver) lookupIPs(ctx context.Context, resolver *net.Resolver, host string, port string) ([]string, error) {
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, net.JoinHostPort(ip.IP.String(), port))
+	}
+	return addresses, nil
+}
+
+func (this *DNSResolver) lookupSRV(ctx context.Context, resolver *net.Resolver, name string) ([]string, error) {
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, record := range records {
+		port := strconv.Itoa(int(record.Port))
+		target := strings.TrimSuffix(record.Target, ".")
+		ips, err := this.lookupIPs(ctx, resolver, target, port)
+		if err != nil {
+			//target解析不了时交给Dial时再解析
+			log.Println("DNSResolver lookup ", target, " : ", err.Error())
+			addresses = append(addresses, net.JoinHostPort(target, port))
+			continue
+		}
+		addresses = append(addresses, ips...)
+	}
+	return addresses, nil
+}
+
+func (this *DNSResolver) resolve(target string) ([]string, error) {
+	timeout := this.Timeout
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resolver := this.netResolver()
+	var addresses []string
+	var err error
+	if strings.HasPrefix(target, "_") {
+		addresses, err = this.lookupSRV(ctx, resolver, target)
+	} else {
+		host, port, e := net.SplitHostPort(target)
+		if e != nil {
+			return nil, fmt.Errorf("DNSResolver : invalid target %q, expect host:port", target)
+		}
+		addresses, err = this.lookupIPs(ctx, resolver, host, port)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+//解析成功的组在返回的结果中，有组解析失败时同时返回*PartialError
+func (this *DNSResolver) Resolve() (map[string][]string, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	groups := make(map[string][]string, len(this.Targets))
+	var failed map[string]error
+	for name, target := range this.Targets {
+		addresses, err := this.resolve(target)
+		if err != nil {
+			log.Println("DNSResolver resolve ", name, " ", target, " : ", err.Error())
+			if failed == nil {
+				failed = make(map[string]error)
+			}
+			failed[name] = err
+			continue
+		}
+		groups[name] = addresses
+	}
+
+	if failed != nil {
+		return groups, &PartialError{Failed: failed}
+	}
+	return groups, nil
+}
@@ -0,0 +1,165 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+const (
+	dnsTypeA   = 1
+	dnsTypeSRV = 33
+)
+
+type srvRecord struct {
+	port   uint16
+	target string
+}
+
+//本地UDP上的DNS服务，只回答A和SRV查询，其他名字回NXDOMAIN，AAAA回空结果
+type stubDNS struct {
+	conn *net.UDPConn
+	a    map[string][]string
+	srv  map[string][]srvRecord
+}
+
+func newStubDNS(t *testing.T, a map[string][]string, srv map[string][]srvRecord) *stubDNS {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubDNS{conn: conn, a: a, srv: srv}
+	go stub.serve()
+	return stub
+}
+
+func (this *stubDNS) Addr() string {
+	return this.conn.LocalAddr().String()
+}
+
+func (this *stubDNS) Close() {
+	this.conn.Close()
+}
+
+func (this *stubDNS) serve() {
+	buffer := make([]byte, 1500)
+	for {
+		n, peer, err := this.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if reply := this.answer(buffer[:n]); reply != nil {
+			this.conn.WriteToUDP(reply, peer)
+		}
+	}
+}
+
+func encodeName(name string) []byte {
+	var buffer []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		buffer = append(buffer, byte(len(label)))
+		buffer = append(buffer, label...)
+	}
+	return append(buffer, 0)
+}
+
+func (this *stubDNS) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	//问题部分：名字 + type(2) + class(2)
+	var labels []string
+	offset := 12
+	for offset < len(query) && query[offset] != 0 {
+		n := int(query[offset])
+		if offset + 1 + n > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[offset + 1 : offset + 1 + n]))
+		offset += 1 + n
+	}
+	offset++
+	if offset + 4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[offset:])
+	question := query[12 : offset + 4]
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	var answers [][]byte
+	_, hasA := this.a[name]
+	_, hasSRV := this.srv[name]
+	switch qtype {
+	case dnsTypeA:
+		for _, ip := range this.a[name] {
+			answers = append(answers, net.ParseIP(ip).To4())
+		}
+	case dnsTypeSRV:
+		for _, record := range this.srv[name] {
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata[4:], record.port)
+			answers = append(answers, append(rdata, encodeName(record.target)...))
+		}
+	}
+
+	reply := make([]byte, 12)
+	copy(reply, query[:2])
+	flags := uint16(0x8180) // 回应，RD，RA
+	if !hasA && !hasSRV {
+		flags |= 3 // NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(reply[2:], flags)
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	binary.BigEndian.PutUint16(reply[6:], uint16(len(answers)))
+	reply = append(reply, question...)
+	for _, rdata := range answers {
+		rr := []byte{0xC0, 12} // 指向问题中的名字
+		rr = binary.BigEndian.AppendUint16(rr, qtype)
+		rr = binary.BigEndian.AppendUint16(rr, 1)
+		rr = binary.BigEndian.AppendUint32(rr, 60)
+		rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+		reply = append(reply, append(rr, rdata...)...)
+	}
+	return reply
+}
+
+func TestDNSResolver(t *testing.T) {
+	stub := newStubDNS(t, map[string][]string{
+		"n1.svc.test":  {"10.0.0.1"},
+		"n2.svc.test":  {"10.0.0.2"},
+		"web.svc.test": {"10.0.0.4", "10.0.0.3"},
+	}, map[string][]srvRecord{
+		"_logic._tcp.svc.test": {{8002, "n2.svc.test."}, {8001, "n1.svc.test."}},
+	})
+	defer stub.Close()
+
+	resolver := &DNSResolver{
+		Targets: map[string]string{
+			"logic":   "_logic._tcp.svc.test",
+			"web":     "web.svc.test:9000",
+			"missing": "missing.svc.test:9000",
+		},
+		Server: stub.Addr(),
+	}
+
+	groups, err := resolver.Resolve()
+	partial, ok := err.(*PartialError)
+	if !ok || len(partial.Failed) != 1 || partial.Failed["missing"] == nil {
+		t.Fatalf("err = %v, want PartialError for missing", err)
+	}
+
+	want := map[string][]string{
+		"logic": {"10.0.0.1:8001", "10.0.0.2:8002"},
+		"web":   {"10.0.0.3:9000", "10.0.0.4:9000"},
+	}
+	if len(groups) != len(want) {
+		t.Errorf("groups = %v, want %v", groups, want)
+	}
+	for name, addresses := range want {
+		if !sameAddresses(groups[name], addresses) {
+			t.Errorf("%s = %v, want %v", name, groups[name], addresses)
+		}
+	}
+}
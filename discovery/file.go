@@ -0,0 +1,152 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//从本地文件读取组名和地址，文件的修改时间和大小没有变化时直接返回上一次的结果
+//按扩展名识别格式：
+//  .json        : {"ctl_client": ["127.0.0.1:8000", "127.0.0.1:8001"]}
+//  .yaml / .yml : 只支持 组名 -> 地址列表 这一种结构
+//      ctl_client:
+//        - 127.0.0.1:8000
+//      lb_client: [127.0.0.1:9000, 127.0.0.1:9001]
+//      db_proxy: 127.0.0.1:7000
+type FileResolver struct {
+	Path string
+
+	lock    sync.Mutex
+	modTime time.Time
+	size    int64
+	groups  map[string][]string
+}
+
+func NewFileResolver(path string) *FileResolver {
+	return &FileResolver{
+		Path: path,
+	}
+}
+
+func (this *FileResolver) Resolve() (map[string][]string, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	info, err := os.Stat(this.Path)
+	if err != nil {
+		return nil, err
+	}
+	if this.groups != nil && info.ModTime().Equal(this.modTime) && info.Size() == this.size {
+		return this.groups, nil
+	}
+
+	data, err := ioutil.ReadFile(this.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups map[string][]string
+	switch strings.ToLower(filepath.Ext(this.Path)) {
+	case ".yaml", ".yml":
+		groups, err = parseYAML(data)
+	default:
+		err = json.Unmarshal(data, &groups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("FileResolver %s : %s", this.Path, err.Error())
+	}
+	if groups == nil {
+		groups = make(map[string][]string)
+	}
+
+	this.modTime = info.ModTime()
+	this.size = info.Size()
+	this.groups = groups
+	return groups, nil
+}
+
+func trimYAMLValue(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return value
+}
+
+//去掉行尾的注释，"#"前面必须是空白，避免误伤地址中的字符
+func stripYAMLComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseYAML(data []byte) (map[string][]string, error) {
+	groups := make(map[string][]string)
+	current := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		raw := stripYAMLComment(scanner.Text())
+		line := strings.TrimSpace(raw)
+		if line == "" || line == "---" {
+			continue
+		}
+
+		//列表项，属于上面最近的一个组
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			if current == "" {
+				return nil, fmt.Errorf("line %d : list item without group", lineNo)
+			}
+			if value := trimYAMLValue(strings.TrimPrefix(line, "-")); value != "" {
+				groups[current] = append(groups[current], value)
+			}
+			continue
+		}
+
+		if raw[0] == ' ' || raw[0] == '\t' {
+			return nil, fmt.Errorf("line %d : unexpected indentation", lineNo)
+		}
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return nil, fmt.Errorf("line %d : expect \"name:\"", lineNo)
+		}
+
+		current = trimYAMLValue(line[:colon])
+		if _, exist := groups[current]; !exist {
+			groups[current] = []string{}
+		}
+
+		value := strings.TrimSpace(line[colon+1:])
+		if value == "" {
+			continue
+		}
+		if value[0] != '[' {
+			groups[current] = append(groups[current], trimYAMLValue(value))
+			continue
+		}
+		if value[len(value)-1] != ']' {
+			return nil, fmt.Errorf("line %d : unterminated list", lineNo)
+		}
+		for _, item := range strings.Split(value[1:len(value)-1], ",") {
+			if item = trimYAMLValue(item); item != "" {
+				groups[current] = append(groups[current], item)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
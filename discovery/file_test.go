@@ -0,0 +1,65 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string][]string
+		err   bool
+	}{
+		{"list", "ctl_client:\n  - 127.0.0.1:8000\n  - \"127.0.0.1:8001\" # comment\n",
+			map[string][]string{"ctl_client": {"127.0.0.1:8000", "127.0.0.1:8001"}}, false},
+		{"flow list", "lb_client: [127.0.0.1:9000, '127.0.0.1:9001']\n",
+			map[string][]string{"lb_client": {"127.0.0.1:9000", "127.0.0.1:9001"}}, false},
+		{"scalar and empty", "---\ndb_proxy: 127.0.0.1:7000\nempty:\n",
+			map[string][]string{"db_proxy": {"127.0.0.1:7000"}, "empty": {}}, false},
+		{"item without group", "- 127.0.0.1:8000\n", nil, true},
+		{"unterminated list", "a: [1.1.1.1:1\n", nil, true},
+		{"bad indentation", "a:\n  b: 1\n", nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseYAML([]byte(test.input))
+		if (err != nil) != test.err {
+			t.Errorf("%s: err = %v", test.name, err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dovenet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "servers.json")
+	if err := ioutil.WriteFile(path, []byte(`{"g": ["127.0.0.1:8000"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resolver := NewFileResolver(path)
+	groups, err := resolver.Resolve()
+	if err != nil || !reflect.DeepEqual(groups, map[string][]string{"g": {"127.0.0.1:8000"}}) {
+		t.Fatalf("Resolve = %v, %v", groups, err)
+	}
+
+	//文件变化后重新读取，格式错误时返回错误
+	if err := ioutil.WriteFile(path, []byte(`{"g": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolver.Resolve(); err == nil {
+		t.Errorf("Resolve of a broken file succeeded")
+	}
+}
@@ -1,53 +1,236 @@
 package protocol
 
 import (
+	"errors"
 	"net"
 	"io"
 	log "github.com/sotter/dovenet/log"
 	"fmt"
 	"encoding/binary"
 	"bytes"
+	"hash/crc32"
+	"sync/atomic"
+	"time"
 )
 
 type CommCodec struct {
-	TcpConn net.Conn
+	TcpConn     net.Conn
+	protocol    *CommProtocol
+	peerVersion uint32 // 对端最近一个包的头部版本，0表示还没有收到过
+
+	//v1的心跳请求和回应格式完全一样，只能根据本端的状态区分
+	pingPending int32  // 发出了心跳请求还没有收到回应
+	lastPong    int64  // 最近一次回应心跳的时间，UnixNano
 }
 
-func NewCommCodec(tcpConn net.Conn) *CommCodec {
+//v1中收到回应之后，这个时间内再收到的心跳认为是老版本把我们的回应原样回显回来的
+const heartBeatEchoWindow = time.Second
+
+func NewCommCodec(tcpConn net.Conn, p *CommProtocol) *CommCodec {
 	return &CommCodec {
 		TcpConn : tcpConn,
+		protocol : p,
 	}
 }
 
+//CommSplitHeader.Flags，只有v2头部中有这个字段，v1头部和老版本完全一致，不带任何标记
+//所以校验、压缩、应答等需要标记的功能，只在发送v2头部时才会使用，见writeVersion
+//低3位为压缩算法的编号，见compress.go
+const (
+	FlagChecksum  uint8 = 0x80 // 包体后面跟4字节的CRC32C校验，校验范围为头部+包体
+	FlagReply     uint8 = 0x40 // 应答包，Seq为对应请求的Seq
+	FlagError     uint8 = 0x20 // 错误应答，包体为错误信息
+	FlagHeartBeat uint8 = 0x10 // 心跳包，v1中MsgType为0同样表示心跳
+)
+
+//头部版本
+//  v1 : Magic(4) MsgType(2) Length(4)                                            共10字节
+//  v2 : Magic(4) Version(1) Flags(1) MsgType(2) Seq(4) ExtLen(2) Length(4) Ext   共18字节+Ext
+//两个版本使用不同的魔数，收包时根据魔数自动识别，新老版本的节点可以混合部署
+const (
+	HeaderVersion1 uint8 = 1
+	HeaderVersion2 uint8 = 2
+
+	HeaderV1Size = 10
+	HeaderV2Size = 18
+)
+
+const (
+	checksumSize = 4
+	maxExtLength = 0xFFFF
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+//包体超过MaxBodyLength，对端收到也会断开连接，在发送时直接返回错误
+var ErrorBodyTooLong error = errors.New("Body too long")
+
+//v2头部的扩展字段，按 Type(1) Length(2) Value 编码
+type CommExt struct {
+	Type  uint8
+	Value []byte
+}
+
 type CommSplitHeader struct {
 	MagicNumber uint32      // 第一个比较为一个魔数，用于分包标记
 	MsgType     uint16      // 消息类型
 	Length      uint32      // 第二个字段为长度
+
+	//以下字段只在v2头部中存在，v1头部编码时忽略
+	Flags       uint8       // 选项标记
+	Version     uint8       // 收包时为对端使用的版本；发包时由Codec根据配置决定
+	Seq         uint32      // 序列号，用于请求和应答的对应
+	Ext         []CommExt   // 扩展字段
+}
+
+func (this *CommSplitHeader) extSize() int {
+	size := 0
+	for _, ext := range this.Ext {
+		size += 3 + len(ext.Value)
+	}
+	return size
+}
+
+//编码后头部的长度
+func (this *CommSplitHeader) Size() int {
+	if this.Version >= HeaderVersion2 {
+		return HeaderV2Size + this.extSize()
+	}
+	return HeaderV1Size
+}
+
+func (this *CommSplitHeader) GetExt(t uint8) ([]byte, bool) {
+	for _, ext := range this.Ext {
+		if ext.Type == t {
+			return ext.Value, true
+		}
+	}
+	return nil, false
+}
+
+//设置扩展字段，已经存在的同类型字段会被覆盖
+func (this *CommSplitHeader) SetExt(t uint8, value []byte) {
+	for i := range this.Ext {
+		if this.Ext[i].Type == t {
+			this.Ext[i].Value = value
+			return
+		}
+	}
+	this.Ext = append(this.Ext, CommExt{Type: t, Value: value})
 }
 
 func (this *CommSplitHeader) Decode(buffer []byte) error {
-	if len(buffer) < 10 {
+	if len(buffer) < HeaderV1Size {
 		return fmt.Errorf("Decode CommSplitHeader, buffer len is not enough !!! ")
 	}
 
 	this.MagicNumber = binary.BigEndian.Uint32(buffer[0:4])
+	if this.MagicNumber == GMagicNumberV2 {
+		return this.decodeV2(buffer)
+	}
+
+	this.Version = HeaderVersion1
 	this.MsgType = binary.BigEndian.Uint16(buffer[4:6])
 	this.Length = binary.BigEndian.Uint32(buffer[6:10])
+	this.Flags = 0
+	this.Seq = 0
+	this.Ext = nil
+
+	return nil
+}
+
+func (this *CommSplitHeader) decodeV2(buffer []byte) error {
+	if len(buffer) < HeaderV2Size {
+		return fmt.Errorf("Decode CommSplitHeader v2, buffer len is not enough !!! ")
+	}
+
+	this.Version = buffer[4]
+	this.Flags = buffer[5]
+	this.MsgType = binary.BigEndian.Uint16(buffer[6:8])
+	this.Seq = binary.BigEndian.Uint32(buffer[8:12])
+	extLen := int(binary.BigEndian.Uint16(buffer[12:14]))
+	this.Length = binary.BigEndian.Uint32(buffer[14:18])
+
+	if len(buffer) < HeaderV2Size + extLen {
+		return fmt.Errorf("Decode CommSplitHeader v2, ext len is not enough !!! ")
+	}
+
+	this.Ext = nil
+	ext := buffer[HeaderV2Size : HeaderV2Size + extLen]
+	for len(ext) > 0 {
+		if len(ext) < 3 {
+			return fmt.Errorf("Decode CommSplitHeader v2, broken ext field")
+		}
+		n := int(binary.BigEndian.Uint16(ext[1:3]))
+		if len(ext) < 3 + n {
+			return fmt.Errorf("Decode CommSplitHeader v2, broken ext field")
+		}
+		this.Ext = append(this.Ext, CommExt{
+			Type:  ext[0],
+			Value: append([]byte(nil), ext[3:3+n]...),
+		})
+		ext = ext[3+n:]
+	}
 
 	return nil
 }
 
-//把解包后的结果放入到buffer中
+//把解包后的结果放入到buffer中，Version小于2时按v1编码
 func (this *CommSplitHeader)Encode() []byte  {
-	buffer := make([]byte, 10)
-	binary.BigEndian.PutUint32(buffer[0:], this.MagicNumber)
+	if this.Version >= HeaderVersion2 {
+		return this.encodeV2()
+	}
+
+	//从v2的包转成v1发送时，魔数也要换回v1的
+	magic := this.MagicNumber
+	if magic == GMagicNumberV2 {
+		magic = GMagicNumber
+	}
+
+	buffer := make([]byte, HeaderV1Size)
+	binary.BigEndian.PutUint32(buffer[0:], magic)
 	binary.BigEndian.PutUint16(buffer[4:], this.MsgType)
 	binary.BigEndian.PutUint32(buffer[6:], this.Length)
 
 	return buffer
 }
 
-const GMagicNumber = 0x132afabd
+func (this *CommSplitHeader) encodeV2() []byte {
+	buffer := make([]byte, HeaderV2Size, this.Size())
+	binary.BigEndian.PutUint32(buffer[0:], GMagicNumberV2)
+	buffer[4] = HeaderVersion2
+	buffer[5] = this.Flags
+	binary.BigEndian.PutUint16(buffer[6:], this.MsgType)
+	binary.BigEndian.PutUint32(buffer[8:], this.Seq)
+	binary.BigEndian.PutUint16(buffer[12:], uint16(this.extSize()))
+	binary.BigEndian.PutUint32(buffer[14:], this.Length)
+
+	for _, ext := range this.Ext {
+		var tl [3]byte
+		tl[0] = ext.Type
+		binary.BigEndian.PutUint16(tl[1:], uint16(len(ext.Value)))
+		buffer = append(buffer, tl[:]...)
+		buffer = append(buffer, ext.Value...)
+	}
+	return buffer
+}
+
+//CRC32C校验失败
+type ChecksumError struct {
+	MsgType  uint16
+	Expected uint32
+	Actual   uint32
+}
+
+func (this *ChecksumError) Error() string {
+	return fmt.Sprintf("CommCodec checksum mismatch, MsgType %d expected %08x actual %08x",
+		this.MsgType, this.Expected, this.Actual)
+}
+
+const (
+	GMagicNumber   = 0x132afabd
+	GMagicNumberV2 = 0x132afabe
+)
 
 type CommMsg struct {
 	Header CommSplitHeader
@@ -65,34 +248,88 @@ func NewCommMsg(msg_type uint16, body []byte) *CommMsg{
 	}
 }
 
+func (this *CommMsg) Size() int {
+	return this.Header.Size() + len(this.Body)
+}
+
+//对请求的回应，带上请求的Seq和FlagReply，需要v2头部
+func NewReplyMsg(req *CommMsg, msg_type uint16, body []byte) *CommMsg {
+	reply := NewCommMsg(msg_type, body)
+	reply.Header.Seq = req.Header.Seq
+	reply.Header.Flags = FlagReply
+	return reply
+}
+
+//错误回应，包体为错误信息
+func NewErrorReply(req *CommMsg, errMsg string) *CommMsg {
+	reply := NewReplyMsg(req, req.Header.MsgType, []byte(errMsg))
+	reply.Header.Flags |= FlagError
+	return reply
+}
+
 func (this *CommMsg)Serialize() ([]byte, error) {
+	if len(this.Body) > MaxBodyLength {
+		return nil, ErrorBodyTooLong
+	}
+
 	buf := new(bytes.Buffer)
 	//一次把内存分配够
-	buf.Grow(10 + int(this.Header.Length))
-	buf.Write(this.Header.Encode())
+	buf.Grow(this.Header.Size() + int(this.Header.Length))
+	//校验和压缩只能由Codec处理
+	header := this.Header
+	header.Flags &^= FlagChecksum | FlagCompressMask
+	buf.Write(header.Encode())
 	buf.Write(this.Body)
 	return buf.Bytes(), nil
 }
 
+//读取头部，根据魔数识别v1还是v2
+func (this *CommCodec) readHeader(header *CommSplitHeader) ([]byte, error) {
+	head := make([]byte, HeaderV1Size, HeaderV2Size)
+	if _, err := io.ReadFull(this.TcpConn, head); err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(head[0:4]) == GMagicNumberV2 {
+		head = head[:HeaderV2Size]
+		if _, err := io.ReadFull(this.TcpConn, head[HeaderV1Size:]); err != nil {
+			return nil, err
+		}
+		if extLen := int(binary.BigEndian.Uint16(head[12:14])); extLen > 0 {
+			head = append(head, make([]byte, extLen)...)
+			if _, err := io.ReadFull(this.TcpConn, head[HeaderV2Size:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := header.Decode(head); err != nil {
+		return nil, err
+	}
+	if header.Length > MaxBodyLength {
+		return nil, fmt.Errorf("CommCodec Read, body length %d exceeds %d", header.Length, MaxBodyLength)
+	}
+
+	atomic.StoreUint32(&this.peerVersion, uint32(header.Version))
+	return head, nil
+}
+
 func (this *CommCodec) Read() (msg Message, e error)  {
 	for {
-		head := make([]byte, 10)
-		_, err := io.ReadFull(this.TcpConn, head)
+		var msg CommMsg
+		head, err := this.readHeader(&msg.Header)
 		if err != nil {
 			log.Println("WafConn Err :", err.Error())
 			return nil, err
 		}
 
-		var msg CommMsg
-		msg.Header.Decode(head)
-
-		//如果msg_type == 0是心跳包，直接原路返回
-		if msg.Header.MsgType == uint16(0) {
-			this.Write(&msg)
-			return nil, nil
+		//对端开启了校验时，包体后面还有4字节的CRC32C
+		size := int(msg.Header.Length)
+		if msg.Header.Flags & FlagChecksum != 0 {
+			size += checksumSize
 		}
 
-		pdubuf := make([]byte, msg.Header.Length)
+		pdubuf := make([]byte, size)
 		_, err = io.ReadFull(this.TcpConn, pdubuf)
 
 		if err != nil {
@@ -100,14 +337,170 @@ func (this *CommCodec) Read() (msg Message, e error)  {
 			return nil, err
 		}
 
+		if msg.Header.Flags & FlagChecksum != 0 {
+			if err := this.verifyChecksum(&msg.Header, head, pdubuf); err != nil {
+				log.Println("CommCodec Read Err :", err.Error())
+				return nil, err
+			}
+			pdubuf = pdubuf[:msg.Header.Length]
+			msg.Header.Flags &^= FlagChecksum
+		}
+
+		//压缩过的包体在这里解压，业务层看到的永远是原始数据
+		if id := msg.Header.Flags & FlagCompressMask; id != CompressNone {
+			if pdubuf, err = this.decompress(id, pdubuf); err != nil {
+				log.Println("CommCodec Read Err :", err.Error())
+				return nil, err
+			}
+			msg.Header.Length = uint32(len(pdubuf))
+			msg.Header.Flags &^= FlagCompressMask
+		}
+
+		//msg_type == 0或者带有心跳标记的是心跳包，交给TcpConnection处理
+		if msg.Header.MsgType == uint16(0) || msg.Header.Flags & FlagHeartBeat != 0 {
+			return this.heartBeat(&msg.Header), nil
+		}
+
 		msg.Body = pdubuf
 		return &msg, nil
 	}
 }
 
+func (this *CommCodec) verifyChecksum(header *CommSplitHeader, head []byte, pdubuf []byte) error {
+	body := pdubuf[:header.Length]
+	expected := binary.BigEndian.Uint32(pdubuf[header.Length:])
+
+	actual := crc32.Update(crc32.Checksum(head, castagnoliTable), castagnoliTable, body)
+	if actual != expected {
+		if this.protocol != nil {
+			this.protocol.addChecksumError()
+		}
+		return &ChecksumError{
+			MsgType:  header.MsgType,
+			Expected: expected,
+			Actual:   actual,
+		}
+	}
+	return nil
+}
+
+func (this *CommCodec) decompress(id uint8, body []byte) ([]byte, error) {
+	c, err := getCompressor(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decompress(body, MaxBodyLength)
+}
+
+//包体超过阈值时按配置的算法压缩，压缩后没有变小则原样发送
+func (this *CommCodec) compress(header *CommSplitHeader, body []byte) []byte {
+	header.Flags &^= FlagCompressMask
+	if this.protocol == nil || this.protocol.Compress == CompressNone {
+		return body
+	}
+
+	threshold := this.protocol.CompressThreshold
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	if len(body) < threshold {
+		return body
+	}
+
+	c, err := getCompressor(this.protocol.Compress)
+	if err != nil {
+		log.Println("CommCodec compress :", err.Error())
+		return body
+	}
+	compressed, err := c.Compress(body)
+	if err != nil || len(compressed) >= len(body) {
+		return body
+	}
+
+	header.Flags |= this.protocol.Compress & FlagCompressMask
+	return compressed
+}
+
+//发送使用的头部版本：配置了v2时，对端最近发来的是v2才发送v2，否则发送v1；
+//还没有收到过对端的包时，只有配置了V2First才发送v2
+func (this *CommCodec) writeVersion() uint8 {
+	if this.protocol == nil || this.protocol.Version < HeaderVersion2 {
+		return HeaderVersion1
+	}
+	peer := uint8(atomic.LoadUint32(&this.peerVersion))
+	if peer >= HeaderVersion2 || (peer == 0 && this.protocol.V2First) {
+		return HeaderVersion2
+	}
+	return HeaderVersion1
+}
+
+//现在发送的消息能否带上Seq，只有v2头部有Seq
+func (this *CommCodec) SeqSupported() bool {
+	return this.writeVersion() >= HeaderVersion2
+}
+
+//按照本端的配置编码，不修改msg本身，同一个msg可以发给多个连接
+func (this *CommCodec) encode(msg *CommMsg) ([]byte, error) {
+	if len(msg.Body) > MaxBodyLength {
+		return nil, ErrorBodyTooLong
+	}
+
+	header := msg.Header
+	header.Version = this.writeVersion()
+	if header.Version >= HeaderVersion2 && header.extSize() > maxExtLength {
+		log.Println("CommCodec encode : ext too long, dropped")
+		header.Ext = nil
+	}
+	//压缩算法的编号放在Flags中，只有v2头部能带，v1的包不压缩
+	body := msg.Body
+	header.Flags &^= FlagCompressMask
+	if header.Version >= HeaderVersion2 {
+		body = this.compress(&header, body)
+	}
+	header.Length = uint32(len(body))
+	//校验的标记同样只有v2头部能带
+	checksum := this.protocol != nil && this.protocol.Checksum && header.Version >= HeaderVersion2
+	if checksum {
+		header.Flags |= FlagChecksum
+	} else {
+		header.Flags &^= FlagChecksum
+	}
+
+	buffer := make([]byte, 0, header.Size() + len(body) + checksumSize)
+	buffer = append(buffer, header.Encode()...)
+	buffer = append(buffer, body...)
+
+	if checksum {
+		var sum [checksumSize]byte
+		binary.BigEndian.PutUint32(sum[:], crc32.Checksum(buffer, castagnoliTable))
+		buffer = append(buffer, sum[:]...)
+	}
+	return buffer, nil
+}
+
+func (this *CommCodec)Encode(msg Message) ([]byte, error) {
+	if cm, ok := msg.(*CommMsg); ok {
+		return this.encode(cm)
+	}
+	return msg.Serialize()
+}
+
+func (this *CommCodec)EncodeKey() string {
+	if this.protocol == nil {
+		return fmt.Sprintf("comm:v%d", this.writeVersion())
+	}
+	return fmt.Sprintf("comm:v%d:%t:%d:%d", this.writeVersion(), this.protocol.Checksum,
+		this.protocol.Compress, this.protocol.CompressThreshold)
+}
+
 func (this *CommCodec)Write(msg Message) (n int, err error) {
-	buffer, e := msg.Serialize()
-	if e != nil {
+	var buffer []byte
+	if em, ok := msg.(*EncodedMsg); ok {
+		buffer, err = em.EncodeWith(this)
+	} else {
+		buffer, err = this.Encode(msg)
+	}
+	if err != nil {
 		return 0, err
 	}
 	return this.TcpConn.Write(buffer)
@@ -117,17 +510,51 @@ func (this *CommCodec)WriteBinary(msg []byte) (n int, err error) {
 	return this.TcpConn.Write(msg)
 }
 
-//发送心跳包 DoHeartBeat
-func (this *CommCodec)DoHeartBeat() error {
-	ht := &CommMsg {
+//区分心跳的请求和回应：
+//  v2 : 回应带有FlagReply
+//  v1 : 有未回应的请求时算作回应；刚回应过又马上收到的是老版本的回显，也算作回应（丢弃）；其他算作请求
+//       两端都主动发心跳时v1算出来的RTT不准确，需要准确的RTT时只在一端开启心跳或者使用v2
+func (this *CommCodec) heartBeat(header *CommSplitHeader) *HeartBeat {
+	if header.Version >= HeaderVersion2 {
+		if header.Flags & FlagReply != 0 {
+			atomic.StoreInt32(&this.pingPending, 0)
+			return &HeartBeat{Ping: false}
+		}
+		return &HeartBeat{Ping: true, Reply: this.newPong(header.Seq)}
+	}
+
+	if atomic.CompareAndSwapInt32(&this.pingPending, 1, 0) {
+		return &HeartBeat{Ping: false}
+	}
+	if time.Now().UnixNano() - atomic.LoadInt64(&this.lastPong) < int64(heartBeatEchoWindow) {
+		return &HeartBeat{Ping: false}
+	}
+	return &HeartBeat{Ping: true, Reply: this.newPong(header.Seq)}
+}
+
+func (this *CommCodec) newPong(seq uint32) *CommMsg {
+	atomic.StoreInt64(&this.lastPong, time.Now().UnixNano())
+	return &CommMsg {
+		Header : CommSplitHeader {
+			MagicNumber : GMagicNumber,
+			MsgType  : uint16(0),
+			Flags    : FlagHeartBeat | FlagReply,
+			Seq      : seq,
+		},
+	}
+}
+
+//心跳请求 MsgType为0，v2中带有FlagHeartBeat
+func (this *CommCodec)NewHeartBeat() Message {
+	atomic.StoreInt32(&this.pingPending, 1)
+	return &CommMsg {
 		Header : CommSplitHeader {
 			MagicNumber : GMagicNumber,
 			MsgType  : uint16(0),
 			Length   : uint32(0),
+			Flags    : FlagHeartBeat,
 		},
 	}
-	_, err := this.Write(ht)
-	return err
 }
 
 func (this *CommCodec)Close() error {
@@ -0,0 +1,270 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestCommHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		header CommSplitHeader
+		size   int
+		want   CommSplitHeader
+	}{
+		{"v1", CommSplitHeader{MagicNumber: GMagicNumber, MsgType: 7, Length: 100},
+			HeaderV1Size,
+			CommSplitHeader{MagicNumber: GMagicNumber, MsgType: 7, Length: 100, Version: HeaderVersion1}},
+		{"v1 drops flags", CommSplitHeader{MagicNumber: GMagicNumber, MsgType: 7, Length: 100,
+			Flags: FlagChecksum | FlagReply | CompressGzip, Seq: 9},
+			HeaderV1Size,
+			CommSplitHeader{MagicNumber: GMagicNumber, MsgType: 7, Length: 100, Version: HeaderVersion1}},
+		{"v1 length over 16M", CommSplitHeader{MagicNumber: GMagicNumber, MsgType: 7, Length: 1<<24 + 5},
+			HeaderV1Size,
+			CommSplitHeader{MagicNumber: GMagicNumber, MsgType: 7, Length: 1<<24 + 5, Version: HeaderVersion1}},
+		{"v2 magic sent as v1", CommSplitHeader{MagicNumber: GMagicNumberV2, MsgType: 7, Length: 1},
+			HeaderV1Size,
+			CommSplitHeader{MagicNumber: GMagicNumber, MsgType: 7, Length: 1, Version: HeaderVersion1}},
+		{"v2 flags", CommSplitHeader{MsgType: 7, Length: 100, Version: HeaderVersion2,
+			Flags: FlagChecksum | FlagReply | FlagError | CompressZlib, Seq: 9},
+			HeaderV2Size,
+			CommSplitHeader{MagicNumber: GMagicNumberV2, MsgType: 7, Length: 100, Version: HeaderVersion2,
+				Flags: FlagChecksum | FlagReply | FlagError | CompressZlib, Seq: 9}},
+		{"v2 heartbeat", CommSplitHeader{Version: HeaderVersion2, Flags: FlagHeartBeat | FlagReply, Seq: 1},
+			HeaderV2Size,
+			CommSplitHeader{MagicNumber: GMagicNumberV2, Version: HeaderVersion2, Flags: FlagHeartBeat | FlagReply, Seq: 1}},
+		{"v2 ext", CommSplitHeader{MsgType: 1, Length: 3, Version: HeaderVersion2,
+			Ext: []CommExt{{Type: 1, Value: []byte("trace")}, {Type: 2, Value: []byte{}}}},
+			HeaderV2Size + 8 + 3,
+			CommSplitHeader{MagicNumber: GMagicNumberV2, MsgType: 1, Length: 3, Version: HeaderVersion2,
+				Ext: []CommExt{{Type: 1, Value: []byte("trace")}, {Type: 2, Value: []byte{}}}}},
+	}
+
+	for _, test := range tests {
+		buffer := test.header.Encode()
+		if len(buffer) != test.size {
+			t.Errorf("%s: encoded %d bytes, want %d", test.name, len(buffer), test.size)
+			continue
+		}
+
+		var got CommSplitHeader
+		if err := got.Decode(buffer); err != nil {
+			t.Errorf("%s: decode: %v", test.name, err)
+			continue
+		}
+		if got.MagicNumber != test.want.MagicNumber || got.MsgType != test.want.MsgType ||
+			got.Length != test.want.Length || got.Flags != test.want.Flags ||
+			got.Version != test.want.Version || got.Seq != test.want.Seq ||
+			len(got.Ext) != len(test.want.Ext) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+			continue
+		}
+		for i := range got.Ext {
+			if got.Ext[i].Type != test.want.Ext[i].Type || !bytes.Equal(got.Ext[i].Value, test.want.Ext[i].Value) {
+				t.Errorf("%s: ext %d = %+v, want %+v", test.name, i, got.Ext[i], test.want.Ext[i])
+			}
+		}
+	}
+}
+
+//v1头部的Length字段就是包体长度，老版本的节点可以直接解析
+func TestCommV1WireFormat(t *testing.T) {
+	codec := NewCommCodec(nil, &CommProtocol{Checksum: true, Compress: CompressGzip, CompressThreshold: 1})
+	msg := NewReplyMsg(NewCommMsg(1, nil), 5, bytes.Repeat([]byte("a"), 2048))
+
+	buffer, err := codec.Encode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buffer) != HeaderV1Size + 2048 {
+		t.Fatalf("encoded %d bytes, want %d", len(buffer), HeaderV1Size + 2048)
+	}
+	if magic := binary.BigEndian.Uint32(buffer[0:4]); magic != GMagicNumber {
+		t.Errorf("magic = %x, want %x", magic, GMagicNumber)
+	}
+	if length := binary.BigEndian.Uint32(buffer[6:10]); length != 2048 {
+		t.Errorf("length field = %x, want %x", length, 2048)
+	}
+}
+
+func TestCommWriteVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol *CommProtocol
+		peer     uint32
+		want     uint8
+	}{
+		{"no protocol", nil, 0, HeaderVersion1},
+		{"v1", &CommProtocol{}, 2, HeaderVersion1},
+		{"v2 unknown peer", &CommProtocol{Version: 2}, 0, HeaderVersion1},
+		{"v2 first unknown peer", &CommProtocol{Version: 2, V2First: true}, 0, HeaderVersion2},
+		{"v2 peer v2", &CommProtocol{Version: 2}, 2, HeaderVersion2},
+		{"v2 peer v1", &CommProtocol{Version: 2}, 1, HeaderVersion1},
+		{"v2 first peer v1", &CommProtocol{Version: 2, V2First: true}, 1, HeaderVersion1},
+	}
+
+	for _, test := range tests {
+		codec := NewCommCodec(nil, test.protocol)
+		codec.peerVersion = test.peer
+		if got := codec.writeVersion(); got != test.want {
+			t.Errorf("%s: writeVersion = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+//按配置编码后再由另一端解码，校验、压缩和标记对业务层透明
+func TestCommCodecRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte("dovenet "), 512)
+	tests := []struct {
+		name     string
+		protocol *CommProtocol
+		flags    uint8
+		wire     uint8 // 发送的头部中应该带的标记
+	}{
+		{"v1", &CommProtocol{}, 0, 0},
+		{"v1 options ignored", &CommProtocol{Checksum: true, Compress: CompressGzip}, 0, 0},
+		{"v2", &CommProtocol{Version: 2, V2First: true}, FlagReply, FlagReply},
+		{"v2 checksum", &CommProtocol{Version: 2, V2First: true, Checksum: true}, FlagReply, FlagReply | FlagChecksum},
+		{"v2 gzip", &CommProtocol{Version: 2, V2First: true, Compress: CompressGzip}, 0, CompressGzip},
+		{"v2 zlib checksum", &CommProtocol{Version: 2, V2First: true, Compress: CompressZlib, Checksum: true},
+			FlagReply | FlagError, FlagReply | FlagError | FlagChecksum | CompressZlib},
+	}
+
+	for _, test := range tests {
+		client, server := net.Pipe()
+		writer := NewCommCodec(client, test.protocol)
+		reader := NewCommCodec(server, &CommProtocol{})
+
+		msg := NewCommMsg(3, body)
+		msg.Header.Flags = test.flags
+		msg.Header.Seq = 42
+		buffer, err := writer.Encode(msg)
+		if err != nil {
+			t.Errorf("%s: encode: %v", test.name, err)
+			continue
+		}
+		var header CommSplitHeader
+		if err := header.Decode(buffer); err != nil {
+			t.Errorf("%s: decode header: %v", test.name, err)
+			continue
+		}
+		if header.Flags != test.wire {
+			t.Errorf("%s: wire flags = %#x, want %#x", test.name, header.Flags, test.wire)
+		}
+
+		go func() {
+			client.Write(buffer)
+		}()
+		read, err := reader.Read()
+		client.Close()
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: read: %v", test.name, err)
+			continue
+		}
+
+		got, ok := read.(*CommMsg)
+		if !ok {
+			t.Errorf("%s: read %T", test.name, read)
+			continue
+		}
+		if !bytes.Equal(got.Body, body) || got.Header.Length != uint32(len(body)) {
+			t.Errorf("%s: body %d bytes, length %d, want %d", test.name, len(got.Body), got.Header.Length, len(body))
+		}
+		//校验和压缩的标记在读取时处理掉，业务层只看到其他标记
+		if want := test.wire &^ (FlagChecksum | FlagCompressMask); got.Header.Flags != want {
+			t.Errorf("%s: flags = %#x, want %#x", test.name, got.Header.Flags, want)
+		}
+	}
+}
+
+func TestCommBodyTooLong(t *testing.T) {
+	msg := NewCommMsg(1, make([]byte, MaxBodyLength + 1))
+	codec := NewCommCodec(nil, &CommProtocol{})
+	if _, err := codec.Encode(msg); err != ErrorBodyTooLong {
+		t.Errorf("Encode err = %v, want ErrorBodyTooLong", err)
+	}
+	if _, err := msg.Serialize(); err != ErrorBodyTooLong {
+		t.Errorf("Serialize err = %v, want ErrorBodyTooLong", err)
+	}
+
+	msg = NewCommMsg(1, make([]byte, MaxBodyLength))
+	if _, err := codec.Encode(msg); err != nil {
+		t.Errorf("Encode max body err = %v", err)
+	}
+}
+
+//区分心跳的请求和回应，见CommCodec.heartBeat
+func TestCommHeartBeat(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  CommSplitHeader
+		pending bool // 有未回应的心跳请求
+		ponged  bool // 刚回应过心跳
+		ping    bool
+	}{
+		{"v2 ping", CommSplitHeader{Version: HeaderVersion2, Flags: FlagHeartBeat, Seq: 5}, false, false, true},
+		{"v2 ping while pending", CommSplitHeader{Version: HeaderVersion2, Flags: FlagHeartBeat, Seq: 5}, true, true, true},
+		{"v2 pong", CommSplitHeader{Version: HeaderVersion2, Flags: FlagHeartBeat | FlagReply}, true, false, false},
+		{"v1 pong", CommSplitHeader{Version: HeaderVersion1}, true, false, false},
+		{"v1 ping", CommSplitHeader{Version: HeaderVersion1}, false, false, true},
+		{"v1 echo of our pong", CommSplitHeader{Version: HeaderVersion1}, false, true, false},
+	}
+
+	for _, test := range tests {
+		codec := NewCommCodec(nil, &CommProtocol{})
+		if test.pending {
+			codec.NewHeartBeat()
+		}
+		if test.ponged {
+			codec.newPong(0)
+		}
+
+		hb := codec.heartBeat(&test.header)
+		if hb.Ping != test.ping {
+			t.Errorf("%s: Ping = %v, want %v", test.name, hb.Ping, test.ping)
+			continue
+		}
+		if !test.ping {
+			if hb.Reply != nil {
+				t.Errorf("%s: pong answered with %v", test.name, hb.Reply)
+			}
+			if test.pending && codec.pingPending != 0 {
+				t.Errorf("%s: pong did not clear the pending ping", test.name)
+			}
+			continue
+		}
+		reply, ok := hb.Reply.(*CommMsg)
+		if !ok || reply.Header.Flags != FlagHeartBeat | FlagReply || reply.Header.Seq != test.header.Seq {
+			t.Errorf("%s: reply = %+v, want a heartbeat reply with Seq %d", test.name, hb.Reply, test.header.Seq)
+		}
+	}
+}
+
+//包体被改动时读取返回ChecksumError，并计入接收端协议的ChecksumErrors
+func TestCommChecksumMismatch(t *testing.T) {
+	writer := NewCommCodec(nil, &CommProtocol{Version: 2, V2First: true, Checksum: true})
+	buffer, err := writer.Encode(NewCommMsg(3, []byte("dovenet")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer[HeaderV2Size] ^= 0xFF
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		client.Write(buffer)
+	}()
+
+	p := &CommProtocol{}
+	_, err = NewCommCodec(server, p).Read()
+	if cerr, ok := err.(*ChecksumError); !ok || cerr.MsgType != 3 || cerr.Expected == cerr.Actual {
+		t.Errorf("read err = %v, want a ChecksumError for MsgType 3", err)
+	}
+	if n := p.ChecksumErrors(); n != 1 {
+		t.Errorf("ChecksumErrors = %d, want 1", n)
+	}
+}
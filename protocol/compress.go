@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+//压缩算法的编号，放在CommSplitHeader.Flags的低3位，0表示没有压缩
+//1、2为内置的gzip和zlib，3-7留给业务自己注册，如snappy、zstd，两端注册的编号要一致
+const (
+	CompressNone uint8 = 0
+	CompressGzip uint8 = 1
+	CompressZlib uint8 = 2
+
+	FlagCompressMask uint8 = 0x07
+	MaxCompressorID  uint8 = 7
+)
+
+//默认超过1K的包体才压缩
+const DefaultCompressThreshold = 1024
+
+//包体的最大长度，超过时发送返回ErrorBodyTooLong，接收时断开连接；解压后同样不能超过，防止压缩炸弹
+const MaxBodyLength = 1 << 23 // 8M
+
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	//解压后的长度超过maxSize时返回错误
+	Decompress(data []byte, maxSize int) ([]byte, error)
+}
+
+var (
+	compressorLock sync.RWMutex
+	compressors    = map[uint8]Compressor{
+		CompressGzip: &GzipCompressor{},
+		CompressZlib: &ZlibCompressor{},
+	}
+)
+
+//注册自定义的压缩算法，id的范围为1-7，可以覆盖内置的实现
+func RegisterCompressor(id uint8, c Compressor) error {
+	if id == CompressNone || id > MaxCompressorID {
+		return fmt.Errorf("RegisterCompressor : id %d out of range [1, %d]", id, MaxCompressorID)
+	}
+	if c == nil {
+		return fmt.Errorf("RegisterCompressor : nil compressor for id %d", id)
+	}
+
+	compressorLock.Lock()
+	defer compressorLock.Unlock()
+	compressors[id] = c
+	return nil
+}
+
+func getCompressor(id uint8) (Compressor, error) {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+	c, exist := compressors[id]
+	if !exist {
+		return nil, fmt.Errorf("Compressor %d is not registered", id)
+	}
+	return c, nil
+}
+
+func readAllLimited(r io.Reader, maxSize int) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("Decompressed body exceeds %d bytes", maxSize)
+	}
+	return data, nil
+}
+
+type GzipCompressor struct{}
+
+func (this *GzipCompressor) Compress(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (this *GzipCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAllLimited(r, maxSize)
+}
+
+type ZlibCompressor struct{}
+
+func (this *ZlibCompressor) Compress(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := zlib.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (this *ZlibCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAllLimited(r, maxSize)
+}
@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressorRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("dovenet "), 1024)
+	for _, id := range []uint8{CompressGzip, CompressZlib} {
+		c, err := getCompressor(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := c.Compress(data)
+		if err != nil {
+			t.Fatalf("compressor %d: %v", id, err)
+		}
+		if got, err := c.Decompress(compressed, len(data)); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("compressor %d: decompressed %d bytes, err %v", id, len(got), err)
+		}
+		//解压后超过限制的视为压缩炸弹
+		if _, err := c.Decompress(compressed, len(data)-1); err == nil {
+			t.Errorf("compressor %d: decompressed beyond maxSize", id)
+		}
+	}
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	tests := []struct {
+		name string
+		id   uint8
+		c    Compressor
+		ok   bool
+	}{
+		{"none", CompressNone, &GzipCompressor{}, false},
+		{"out of range", MaxCompressorID + 1, &GzipCompressor{}, false},
+		{"nil", 5, nil, false},
+		{"custom", 5, &ZlibCompressor{}, true},
+	}
+
+	for _, test := range tests {
+		if err := RegisterCompressor(test.id, test.c); (err == nil) != test.ok {
+			t.Errorf("%s: err = %v", test.name, err)
+		}
+	}
+	if _, err := getCompressor(6); err == nil {
+		t.Errorf("unregistered compressor found")
+	}
+}
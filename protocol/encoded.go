@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"sync"
+)
+
+//已经编码好的原始字节，Codec直接原样写出
+type RawMsg []byte
+
+func (this RawMsg) Serialize() ([]byte, error) {
+	return this, nil
+}
+
+func (this RawMsg) Size() int {
+	return len(this)
+}
+
+//编码结果依赖于自身配置（校验、压缩、头部版本等）的Codec实现这个接口
+type Encoder interface {
+	Encode(msg Message) ([]byte, error)
+	//编码结果相同的Codec返回相同的key
+	EncodeKey() string
+}
+
+//预先编码的消息，发给多个连接时每一种编码配置只编码一次，广播时使用
+type EncodedMsg struct {
+	Msg   Message
+
+	lock  sync.Mutex
+	cache map[string][]byte
+}
+
+func NewEncodedMsg(msg Message) *EncodedMsg {
+	return &EncodedMsg{
+		Msg:   msg,
+		cache: make(map[string][]byte),
+	}
+}
+
+func (this *EncodedMsg) encode(key string, encode func() ([]byte, error)) ([]byte, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if buffer, exist := this.cache[key]; exist {
+		return buffer, nil
+	}
+	buffer, err := encode()
+	if err != nil {
+		return nil, err
+	}
+	this.cache[key] = buffer
+	return buffer, nil
+}
+
+//不依赖Codec配置的编码结果，即Msg.Serialize()
+func (this *EncodedMsg) Serialize() ([]byte, error) {
+	return this.encode("", this.Msg.Serialize)
+}
+
+//按Codec的配置编码，相同配置的Codec共享同一份结果
+func (this *EncodedMsg) EncodeWith(enc Encoder) ([]byte, error) {
+	return this.encode(enc.EncodeKey(), func() ([]byte, error) {
+		return enc.Encode(this.Msg)
+	})
+}
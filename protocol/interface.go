@@ -8,14 +8,44 @@ type Message interface {
 	Serialize() ([]byte, error)
 }
 
+//能给出自身在线上大约占多少字节的消息，服务端按字节数限流时使用
+type Sized interface {
+	Size() int
+}
+
 type Conn interface {
 	Read() (msg Message, e error)
 	Write(msg Message) (n int, err error)
 	WriteBinary(msg []byte) (n int, err error)
 	Close() error
-	DoHeartBeat() error
+	//生成一个心跳请求，由TcpConnection放入发送队列；协议不支持主动心跳时返回nil
+	NewHeartBeat() Message
 }
 
+//conn一般是*net.TCPConn，也可能是包装过的连接（如base.ProxyConn）
 type Protocol interface {
-	NewCodec(conn *net.TCPConn) Conn
-}
\ No newline at end of file
+	NewCodec(conn net.Conn) Conn
+}
+
+//能带上请求Seq的连接，按Seq匹配回应时使用，见CommCodec.SeqSupported
+type SeqConn interface {
+	SeqSupported() bool
+}
+
+//服务端连接数超过限制时，支持的协议先给对端发一个服务繁忙的消息再关闭连接
+type BusyProtocol interface {
+	BusyMessage() Message
+}
+
+//心跳事件，Codec.Read读到心跳包时返回，由TcpConnection处理，不会交给业务层
+//  Ping  : true为对端发来的心跳请求，false为对端对我们心跳请求的回应
+//  Reply : 需要回给对端的回应，经过正常的发送队列发出，不需要回应时为nil
+type HeartBeat struct {
+	Ping  bool
+	Reply Message
+}
+
+//心跳事件本身不会被发送
+func (this *HeartBeat) Serialize() ([]byte, error) {
+	return nil, nil
+}
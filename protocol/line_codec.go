@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	log "github.com/sotter/dovenet/log"
+)
+
+const (
+	DefaultMaxLineLength = 64 * 1024
+	DefaultPingLine      = "PING"
+	DefaultPongLine      = "PONG"
+)
+
+var ErrorLineTooLong error = errors.New("Line too long")
+
+//一行文本，不包含行尾的分隔符
+type LineMsg struct {
+	Line []byte
+}
+
+func NewLineMsg(line string) *LineMsg {
+	return &LineMsg{
+		Line: []byte(line),
+	}
+}
+
+func (this *LineMsg) String() string {
+	return string(this.Line)
+}
+
+func (this *LineMsg) Size() int {
+	return len(this.Line) + 1
+}
+
+func (this *LineMsg) Serialize() ([]byte, error) {
+	buffer := make([]byte, len(this.Line)+1)
+	copy(buffer, this.Line)
+	buffer[len(this.Line)] = '\n'
+	return buffer, nil
+}
+
+type LineCodec struct {
+	TcpConn net.Conn
+	reader  *bufio.Reader
+
+	maxLineLength int
+	crlf          bool
+	pingLine      string
+	pongLine      string
+}
+
+func NewLineCodec(tcpConn net.Conn, p *LineProtocol) *LineCodec {
+	codec := &LineCodec{
+		TcpConn:       tcpConn,
+		reader:        bufio.NewReader(tcpConn),
+		maxLineLength: DefaultMaxLineLength,
+		pingLine:      DefaultPingLine,
+		pongLine:      DefaultPongLine,
+	}
+
+	if p != nil {
+		if p.MaxLineLength > 0 {
+			codec.maxLineLength = p.MaxLineLength
+		}
+		if p.PingLine != "" {
+			codec.pingLine = p.PingLine
+		}
+		if p.PongLine != "" {
+			codec.pongLine = p.PongLine
+		}
+		codec.crlf = p.CRLF
+	}
+
+	return codec
+}
+
+//读取一行，超过maxLineLength时返回ErrorLineTooLong，避免对端不发分隔符把内存撑爆
+func (this *LineCodec) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := this.reader.ReadSlice('\n')
+		if len(line)+len(frag) > this.maxLineLength+2 {
+			return nil, ErrorLineTooLong
+		}
+		line = append(line, frag...)
+
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	if len(line) > this.maxLineLength {
+		return nil, ErrorLineTooLong
+	}
+
+	return line, nil
+}
+
+func (this *LineCodec) Read() (msg Message, e error) {
+	line, err := this.readLine()
+	if err != nil {
+		log.Println("LineCodec Read Err :", err.Error())
+		return nil, err
+	}
+
+	//心跳行：收到PING回应PONG
+	switch string(line) {
+	case this.pingLine:
+		return &HeartBeat{Ping: true, Reply: NewLineMsg(this.pongLine)}, nil
+	case this.pongLine:
+		return &HeartBeat{Ping: false}, nil
+	}
+
+	return &LineMsg{Line: line}, nil
+}
+
+func (this *LineCodec) encode(line []byte) []byte {
+	ending := "\n"
+	if this.crlf {
+		ending = "\r\n"
+	}
+	buffer := make([]byte, 0, len(line)+len(ending))
+	buffer = append(buffer, line...)
+	return append(buffer, ending...)
+}
+
+func (this *LineCodec) Encode(msg Message) ([]byte, error) {
+	if lm, ok := msg.(*LineMsg); ok {
+		return this.encode(lm.Line), nil
+	}
+	return msg.Serialize()
+}
+
+func (this *LineCodec) EncodeKey() string {
+	if this.crlf {
+		return "line:crlf"
+	}
+	return "line:lf"
+}
+
+func (this *LineCodec) Write(msg Message) (n int, err error) {
+	var buffer []byte
+	if em, ok := msg.(*EncodedMsg); ok {
+		buffer, err = em.EncodeWith(this)
+	} else {
+		buffer, err = this.Encode(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return this.TcpConn.Write(buffer)
+}
+
+func (this *LineCodec) WriteBinary(msg []byte) (n int, err error) {
+	return this.TcpConn.Write(msg)
+}
+
+func (this *LineCodec) NewHeartBeat() Message {
+	return NewLineMsg(this.pingLine)
+}
+
+func (this *LineCodec) Close() error {
+	return this.TcpConn.Close()
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLineHeartBeat(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol *LineProtocol
+		input    string
+		ping     bool
+		pong     bool
+		reply    string
+		line     string
+	}{
+		{"ping", nil, "PING\n", true, false, "PONG", ""},
+		{"pong", nil, "PONG\r\n", false, true, "", ""},
+		{"lower case", nil, "ping\n", false, false, "", "ping"},
+		{"ping with args", nil, "PING x\n", false, false, "", "PING x"},
+		{"custom ping", &LineProtocol{PingLine: "hb", PongLine: "hb-ok"}, "hb\n", true, false, "hb-ok", ""},
+		{"default ping with custom lines", &LineProtocol{PingLine: "hb", PongLine: "hb-ok"}, "PING\n", false, false, "", "PING"},
+	}
+
+	for _, test := range tests {
+		codec := NewLineCodec(nil, test.protocol)
+		codec.reader.Reset(strings.NewReader(test.input))
+		msg, err := codec.Read()
+		if err != nil {
+			t.Errorf("%s: read: %v", test.name, err)
+			continue
+		}
+
+		hb, ok := msg.(*HeartBeat)
+		if ok != (test.ping || test.pong) {
+			t.Errorf("%s: read %T", test.name, msg)
+			continue
+		}
+		if ok {
+			if hb.Ping != test.ping {
+				t.Errorf("%s: ping = %v, want %v", test.name, hb.Ping, test.ping)
+			}
+			if test.ping {
+				if lm, ok := hb.Reply.(*LineMsg); !ok || lm.String() != test.reply {
+					t.Errorf("%s: reply %v, want %q", test.name, hb.Reply, test.reply)
+				}
+			}
+			continue
+		}
+		if lm, ok := msg.(*LineMsg); !ok || lm.String() != test.line {
+			t.Errorf("%s: read %v, want %q", test.name, msg, test.line)
+		}
+	}
+}
+
+func TestLineTooLong(t *testing.T) {
+	codec := NewLineCodec(nil, &LineProtocol{MaxLineLength: 8})
+	codec.reader.Reset(strings.NewReader(strings.Repeat("a", 9) + "\n"))
+	if _, err := codec.Read(); err != ErrorLineTooLong {
+		t.Errorf("err = %v, want ErrorLineTooLong", err)
+	}
+
+	codec.reader.Reset(strings.NewReader(strings.Repeat("a", 8) + "\r\n"))
+	if msg, err := codec.Read(); err != nil || msg.(*LineMsg).String() != strings.Repeat("a", 8) {
+		t.Errorf("max line = %v, %v", msg, err)
+	}
+}
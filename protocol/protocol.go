@@ -2,12 +2,85 @@ package protocol
 
 import (
 	"net"
+	"sync/atomic"
 )
 
+//服务端连接数超过限制时发给对端的消息，包体为原因，见BusyProtocol；在框架保留的MsgType范围内（MsgTypeReserved）
+const MSG_SERVER_BUSY uint16 = 0xFF10
+
 type CommProtocol struct {
+	//发送v2头部时在包体后面附加CRC32C校验，v1的包不带校验；
+	//接收时只要对端带了校验就会验证，不受这个开关影响
+	Checksum       bool
+
+	//发送时包体超过CompressThreshold（默认1K）则用Compress指定的算法压缩，接收时自动解压；
+	//只在发送v2头部时压缩，对端还在使用v1时原样发送
+	Compress          uint8
+	CompressThreshold int
+
+	//发送使用的头部版本，默认v1；设置为2时，对端发来v2头部之后才发送v2，对端发来v1时回退到v1
+	//V2First为true时，还没有收到对端的包时也先发送v2，只能在确认对端都已经升级之后打开；
+	//所以升级时先把所有节点的Version设置为2，再打开主动发起连接一端的V2First
+	Version           uint8
+	V2First           bool
+
+	checksumErrors uint64
+}
+
+func (this *CommProtocol) NewCodec(conn net.Conn) Conn {
+	return NewCommCodec(conn, this)
+}
+
+func (this *CommProtocol) BusyMessage() Message {
+	return NewCommMsg(MSG_SERVER_BUSY, []byte("server busy"))
+}
+
+//校验失败的包的个数
+func (this *CommProtocol) ChecksumErrors() uint64 {
+	return atomic.LoadUint64(&this.checksumErrors)
+}
+
+func (this *CommProtocol) addChecksumError() {
+	atomic.AddUint64(&this.checksumErrors, 1)
+}
+
+//按行分包的文本协议，适用于文本命令类的业务
+type LineProtocol struct {
+	MaxLineLength int    // 单行最大长度（不含分隔符），超过则断开连接，默认64K
+	CRLF          bool   // 发送时是否以"\r\n"结尾，默认"\n"；接收时两者都兼容
+	PingLine      string // 心跳请求行，默认"PING"
+	PongLine      string // 心跳回应行，默认"PONG"
+}
+
+func (this *LineProtocol) NewCodec(conn net.Conn) Conn {
+	return NewLineCodec(conn, this)
+}
+
+func (this *LineProtocol) BusyMessage() Message {
+	return NewLineMsg("BUSY")
+}
+
+//protobuf风格的varint长度前缀分包协议
+type VarintProtocol struct {
+	MaxLength int // 单个包体的最大长度，超过则断开连接，默认8M
+}
+
+func (this *VarintProtocol) NewCodec(conn net.Conn) Conn {
+	return NewVarintCodec(conn, this)
+}
+
+//Redis的RESP2/RESP3协议，既可以用来实现Redis协议的代理服务，也可以作为客户端连接Redis兼容的服务
+type RespProtocol struct {
+	Client        bool // 作为客户端使用时设置为true，用于识别心跳PING的回应
+	MaxBulkLength int  // 单个bulk string的最大长度，默认64M
+	MaxElements   int  // 单个array/map/set的最大元素个数，默认1M
+}
 
+func (this *RespProtocol) NewCodec(conn net.Conn) Conn {
+	return NewRespCodec(conn, this)
 }
 
-func (this *CommProtocol) NewCodec(conn *net.TCPConn) Conn {
-	return NewCommCodec(conn)
+//和Redis达到maxclients时的回应一致
+func (this *RespProtocol) BusyMessage() Message {
+	return NewRespError("ERR max number of clients reached")
 }
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+//0xFF00以上的MsgType保留给框架内部使用
+const MsgTypeReserved uint16 = 0xFF00
+
+//发布订阅使用的MsgType
+//  SUBSCRIBE/UNSUBSCRIBE : 包体为topic的匹配模式
+//  PUBLISH/TOPIC_DATA    : 包体为 TopicLen(2) Topic Payload
+//订阅或取消订阅失败时，服务端用NewErrorReply回一个同样MsgType的错误回应，包体为错误信息
+const (
+	MSG_SUBSCRIBE   uint16 = 0xFF01 // 客户端订阅
+	MSG_UNSUBSCRIBE uint16 = 0xFF02 // 客户端取消订阅
+	MSG_PUBLISH     uint16 = 0xFF03 // 客户端发布
+	MSG_TOPIC_DATA  uint16 = 0xFF04 // 服务端推送给订阅者
+)
+
+const MaxTopicLength = 0xFFFF
+
+func NewSubscribeMsg(pattern string) *CommMsg {
+	return NewCommMsg(MSG_SUBSCRIBE, []byte(pattern))
+}
+
+func NewUnsubscribeMsg(pattern string) *CommMsg {
+	return NewCommMsg(MSG_UNSUBSCRIBE, []byte(pattern))
+}
+
+func encodeTopic(msgType uint16, topic string, payload []byte) *CommMsg {
+	body := make([]byte, 2+len(topic)+len(payload))
+	binary.BigEndian.PutUint16(body, uint16(len(topic)))
+	copy(body[2:], topic)
+	copy(body[2+len(topic):], payload)
+	return NewCommMsg(msgType, body)
+}
+
+func NewPublishMsg(topic string, payload []byte) *CommMsg {
+	return encodeTopic(MSG_PUBLISH, topic, payload)
+}
+
+func NewTopicDataMsg(topic string, payload []byte) *CommMsg {
+	return encodeTopic(MSG_TOPIC_DATA, topic, payload)
+}
+
+//解析PUBLISH和TOPIC_DATA的包体
+func ParseTopicMsg(msg *CommMsg) (topic string, payload []byte, err error) {
+	if len(msg.Body) < 2 {
+		return "", nil, fmt.Errorf("ParseTopicMsg : body too short")
+	}
+	n := int(binary.BigEndian.Uint16(msg.Body))
+	if len(msg.Body) < 2+n {
+		return "", nil, fmt.Errorf("ParseTopicMsg : topic length %d exceeds body", n)
+	}
+	return string(msg.Body[2 : 2+n]), msg.Body[2+n:], nil
+}
+
+//topic以'.'分段，匹配模式中'*'匹配一段，'#'只能在最后，匹配剩下的零段或多段
+//如 "quote.*.sh" 匹配 "quote.600000.sh"，"quote.#" 匹配所有以"quote."开头的topic和"quote"本身
+func ValidTopicPattern(pattern string) error {
+	if pattern == "" || len(pattern) > MaxTopicLength {
+		return fmt.Errorf("Invalid topic pattern length %d", len(pattern))
+	}
+	segments := strings.Split(pattern, ".")
+	for i, seg := range segments {
+		if seg == "" {
+			return fmt.Errorf("Invalid topic pattern %q : empty segment", pattern)
+		}
+		if seg == "#" && i != len(segments)-1 {
+			return fmt.Errorf("Invalid topic pattern %q : '#' must be the last segment", pattern)
+		}
+		if seg != "*" && seg != "#" && strings.ContainsAny(seg, "*#") {
+			return fmt.Errorf("Invalid topic pattern %q : wildcard must be a whole segment", pattern)
+		}
+	}
+	return nil
+}
+
+//发布的topic不能带通配符
+func ValidTopic(topic string) error {
+	if strings.ContainsAny(topic, "*#") {
+		return fmt.Errorf("Invalid topic %q : wildcard not allowed", topic)
+	}
+	return ValidTopicPattern(topic)
+}
+
+func MatchTopic(pattern string, topic string) bool {
+	ps := strings.Split(pattern, ".")
+	ts := strings.Split(topic, ".")
+
+	for i, p := range ps {
+		if p == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if p != "*" && p != ts[i] {
+			return false
+		}
+	}
+	return len(ps) == len(ts)
+}
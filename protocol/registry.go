@@ -0,0 +1,203 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+//CommMsg包体的编解码方式
+type BodyEncoder interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type JsonEncoder struct{}
+
+func (this *JsonEncoder) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (this *JsonEncoder) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+//gob每次都会带上类型描述，适合Go服务之间使用
+type GobEncoder struct{}
+
+func (this *GobEncoder) Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (this *GobEncoder) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+//protobuf生成的消息类型（gogo/protobuf等生成的代码都带有这两个方法）
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+//不依赖具体的protobuf库，直接调用生成代码中的Marshal/Unmarshal
+type ProtoEncoder struct{}
+
+func (this *ProtoEncoder) Marshal(v interface{}) ([]byte, error) {
+	pm, ok := v.(ProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("ProtoEncoder : %T is not a protobuf message", v)
+	}
+	return pm.Marshal()
+}
+
+func (this *ProtoEncoder) Unmarshal(data []byte, v interface{}) error {
+	pm, ok := v.(ProtoMessage)
+	if !ok {
+		return fmt.Errorf("ProtoEncoder : %T is not a protobuf message", v)
+	}
+	return pm.Unmarshal(data)
+}
+
+type typeEntry struct {
+	msgType uint16
+	goType  reflect.Type // 去掉指针之后的类型
+	encoder BodyEncoder
+}
+
+//MsgType与Go类型之间的映射，发送时根据类型找到MsgType并编码，接收时根据MsgType解码成对应的类型
+type TypeRegistry struct {
+	lock    sync.RWMutex
+	encoder BodyEncoder
+	byMsg   map[uint16]*typeEntry
+	byType  map[reflect.Type]*typeEntry
+}
+
+var DefaultRegistry = NewTypeRegistry(&JsonEncoder{})
+
+func NewTypeRegistry(encoder BodyEncoder) *TypeRegistry {
+	if encoder == nil {
+		encoder = &JsonEncoder{}
+	}
+
+	return &TypeRegistry{
+		encoder: encoder,
+		byMsg:   make(map[uint16]*typeEntry),
+		byType:  make(map[reflect.Type]*typeEntry),
+	}
+}
+
+func indirectType(v interface{}) reflect.Type {
+	t, ok := v.(reflect.Type)
+	if !ok {
+		t = reflect.TypeOf(v)
+	}
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+//注册MsgType对应的类型，v可以是该类型的值或者指针，如 (*LoginReq)(nil)
+func (this *TypeRegistry) Register(msgType uint16, v interface{}) error {
+	return this.RegisterWithEncoder(msgType, v, nil)
+}
+
+//注册时单独指定包体的编码方式，encoder为nil时使用Registry默认的
+func (this *TypeRegistry) RegisterWithEncoder(msgType uint16, v interface{}, encoder BodyEncoder) error {
+	//MsgType为0是心跳包，0xFF00以上保留给框架内部使用
+	if msgType == 0 {
+		return fmt.Errorf("Register : MsgType 0 is reserved for heartbeat")
+	}
+	if msgType >= MsgTypeReserved {
+		return fmt.Errorf("Register : MsgType %d is reserved", msgType)
+	}
+
+	t := indirectType(v)
+	if t == nil {
+		return fmt.Errorf("Register : nil type for MsgType %d", msgType)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if old, exist := this.byMsg[msgType]; exist {
+		return fmt.Errorf("Register : MsgType %d already registered with %v", msgType, old.goType)
+	}
+	if old, exist := this.byType[t]; exist {
+		return fmt.Errorf("Register : %v already registered with MsgType %d", t, old.msgType)
+	}
+
+	entry := &typeEntry{
+		msgType: msgType,
+		goType:  t,
+		encoder: encoder,
+	}
+	this.byMsg[msgType] = entry
+	this.byType[t] = entry
+	return nil
+}
+
+func (this *TypeRegistry) lookupType(v interface{}) (*typeEntry, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	entry, exist := this.byType[indirectType(v)]
+	return entry, exist
+}
+
+func (this *TypeRegistry) lookupMsg(msgType uint16) (*typeEntry, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	entry, exist := this.byMsg[msgType]
+	return entry, exist
+}
+
+func (this *TypeRegistry) encoderOf(entry *typeEntry) BodyEncoder {
+	if entry.encoder != nil {
+		return entry.encoder
+	}
+	return this.encoder
+}
+
+//v对应的MsgType，v可以是值、指针或者reflect.Type
+func (this *TypeRegistry) MsgType(v interface{}) (uint16, bool) {
+	entry, exist := this.lookupType(v)
+	if !exist {
+		return 0, false
+	}
+	return entry.msgType, true
+}
+
+//按注册的类型编码成CommMsg
+func (this *TypeRegistry) Encode(v interface{}) (*CommMsg, error) {
+	entry, exist := this.lookupType(v)
+	if !exist {
+		return nil, fmt.Errorf("Encode : %T is not registered", v)
+	}
+
+	body, err := this.encoderOf(entry).Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return NewCommMsg(entry.msgType, body), nil
+}
+
+//按MsgType解码成注册的类型，返回的是指向新对象的指针
+func (this *TypeRegistry) Decode(msg *CommMsg) (interface{}, error) {
+	entry, exist := this.lookupMsg(msg.Header.MsgType)
+	if !exist {
+		return nil, fmt.Errorf("Decode : MsgType %d is not registered", msg.Header.MsgType)
+	}
+
+	v := reflect.New(entry.goType).Interface()
+	if err := this.encoderOf(entry).Unmarshal(msg.Body, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+type loginReq struct {
+	User string
+}
+
+type logoutReq struct {
+	User string
+}
+
+func TestTypeRegistryRegister(t *testing.T) {
+	registry := NewTypeRegistry(nil)
+	if err := registry.Register(1, (*loginReq)(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		msgType uint16
+		v       interface{}
+	}{
+		{"heartbeat", 0, &logoutReq{}},
+		{"reserved", MsgTypeReserved, &logoutReq{}},
+		{"nil type", 2, nil},
+		{"duplicate MsgType", 1, &logoutReq{}},
+		{"duplicate type", 2, loginReq{}},
+	}
+	for _, test := range tests {
+		if err := registry.Register(test.msgType, test.v); err == nil {
+			t.Errorf("%s: registered", test.name)
+		}
+	}
+}
+
+func TestTypeRegistryRoundTrip(t *testing.T) {
+	for _, encoder := range []BodyEncoder{&JsonEncoder{}, &GobEncoder{}} {
+		registry := NewTypeRegistry(encoder)
+		if err := registry.Register(1, loginReq{}); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := registry.Encode(&loginReq{User: "alice"})
+		if err != nil {
+			t.Fatalf("%T: encode: %v", encoder, err)
+		}
+		if msg.Header.MsgType != 1 {
+			t.Errorf("%T: MsgType = %d, want 1", encoder, msg.Header.MsgType)
+		}
+		v, err := registry.Decode(msg)
+		if err != nil || !reflect.DeepEqual(v, &loginReq{User: "alice"}) {
+			t.Errorf("%T: decoded %#v, %v", encoder, v, err)
+		}
+	}
+
+	registry := NewTypeRegistry(nil)
+	if _, err := registry.Encode(&logoutReq{}); err == nil {
+		t.Errorf("unregistered type encoded")
+	}
+	if _, err := registry.Decode(NewCommMsg(9, nil)); err == nil {
+		t.Errorf("unregistered MsgType decoded")
+	}
+}
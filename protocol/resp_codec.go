@@ -0,0 +1,570 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync/atomic"
+	log "github.com/sotter/dovenet/log"
+)
+
+//RESP的数据类型，即每个值的首字节
+const (
+	RespSimpleString byte = '+'
+	RespError        byte = '-'
+	RespInteger      byte = ':'
+	RespBulkString   byte = '$'
+	RespArray        byte = '*'
+
+	//RESP3新增的类型
+	RespNull      byte = '_'
+	RespBoolean   byte = '#'
+	RespDouble    byte = ','
+	RespBigNumber byte = '('
+	RespBulkError byte = '!'
+	RespVerbatim  byte = '='
+	RespMap       byte = '%'
+	RespSet       byte = '~'
+	RespAttribute byte = '|'
+	RespPush      byte = '>'
+)
+
+const (
+	DefaultRespMaxBulkLength = 64 * 1024 * 1024
+	DefaultRespMaxElements   = 1024 * 1024
+	respMaxDepth             = 64
+	respMaxLineLength        = 64 * 1024
+	respBulkChunk            = 64 * 1024
+)
+
+//心跳PING带上的参数，回应中原样带回，用来和业务的回应区分开
+const respHeartBeatToken = "dovenet-heartbeat"
+
+var (
+	ErrorRespProtocol error = errors.New("RESP protocol error")
+	ErrorRespTooLarge error = errors.New("RESP value too large")
+)
+
+//RESP中的一个值
+//  Str   : simple string/error/bulk string/bulk error/verbatim/big number的内容
+//  Int   : integer
+//  Bool  : boolean
+//  Double: double
+//  Elems : array/set/push的元素；map按key, value, key, value...平铺存放
+//  Attrs : 附在这个值上的RESP3 attribute，同样按key, value平铺存放
+//  Null  : RESP2的$-1、*-1或者RESP3的'_'
+//  Inline: 由telnet风格的inline命令解析而来
+type RespValue struct {
+	Type   byte
+	Str    []byte
+	Int    int64
+	Bool   bool
+	Double float64
+	Elems  []*RespValue
+	Attrs  []*RespValue
+	Null   bool
+	Inline bool
+}
+
+func NewRespSimpleString(s string) *RespValue {
+	return &RespValue{Type: RespSimpleString, Str: []byte(s)}
+}
+
+func NewRespError(s string) *RespValue {
+	return &RespValue{Type: RespError, Str: []byte(s)}
+}
+
+func NewRespInteger(n int64) *RespValue {
+	return &RespValue{Type: RespInteger, Int: n}
+}
+
+func NewRespBulk(b []byte) *RespValue {
+	return &RespValue{Type: RespBulkString, Str: b}
+}
+
+//RESP2的空值，即"$-1\r\n"
+func NewRespNullBulk() *RespValue {
+	return &RespValue{Type: RespBulkString, Null: true}
+}
+
+func NewRespArray(elems ...*RespValue) *RespValue {
+	return &RespValue{Type: RespArray, Elems: elems}
+}
+
+//客户端发出的命令，格式为bulk string组成的array
+func NewRespCommand(args ...string) *RespValue {
+	elems := make([]*RespValue, len(args))
+	for i, arg := range args {
+		elems[i] = NewRespBulk([]byte(arg))
+	}
+	return NewRespArray(elems...)
+}
+
+func (this *RespValue) IsError() bool {
+	return this.Type == RespError || this.Type == RespBulkError
+}
+
+//作为命令解析时的命令名（大写）与参数，不是命令格式的返回false
+func (this *RespValue) Command() (name string, args [][]byte, ok bool) {
+	if this.Type != RespArray || this.Null || len(this.Elems) == 0 {
+		return "", nil, false
+	}
+
+	for _, elem := range this.Elems {
+		if elem.Type != RespBulkString && elem.Type != RespSimpleString {
+			return "", nil, false
+		}
+		args = append(args, elem.Str)
+	}
+
+	return string(bytes.ToUpper(args[0])), args[1:], true
+}
+
+func (this *RespValue) String() string {
+	if this.Null {
+		return "(nil)"
+	}
+
+	switch this.Type {
+	case RespInteger:
+		return strconv.FormatInt(this.Int, 10)
+	case RespBoolean:
+		return strconv.FormatBool(this.Bool)
+	case RespDouble:
+		return strconv.FormatFloat(this.Double, 'g', -1, 64)
+	case RespArray, RespSet, RespPush, RespMap:
+		return fmt.Sprint(this.Elems)
+	default:
+		return string(this.Str)
+	}
+}
+
+//大约的大小，每个值按类型字节、长度和CRLF估算
+func (this *RespValue) Size() int {
+	size := 16 + len(this.Str)
+	for _, elem := range this.Elems {
+		size += elem.Size()
+	}
+	for _, attr := range this.Attrs {
+		size += attr.Size()
+	}
+	return size
+}
+
+func (this *RespValue) Serialize() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := this.writeTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeRespHeader(buf *bytes.Buffer, t byte, n int64) {
+	buf.WriteByte(t)
+	buf.WriteString(strconv.FormatInt(n, 10))
+	buf.WriteString("\r\n")
+}
+
+func (this *RespValue) writeTo(buf *bytes.Buffer) error {
+	if len(this.Attrs) > 0 {
+		writeRespHeader(buf, RespAttribute, int64(len(this.Attrs)/2))
+		for _, attr := range this.Attrs {
+			if err := attr.writeTo(buf); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch this.Type {
+	case RespSimpleString, RespError, RespBigNumber:
+		if bytes.ContainsAny(this.Str, "\r\n") {
+			return fmt.Errorf("RESP type %c can not contain CR or LF", this.Type)
+		}
+		buf.WriteByte(this.Type)
+		buf.Write(this.Str)
+		buf.WriteString("\r\n")
+
+	case RespInteger:
+		writeRespHeader(buf, RespInteger, this.Int)
+
+	case RespBulkString, RespBulkError, RespVerbatim:
+		if this.Null {
+			//RESP2只有bulk string和array有空值，RESP3的类型用'_'
+			if this.Type == RespBulkString {
+				buf.WriteString("$-1\r\n")
+			} else {
+				buf.WriteString("_\r\n")
+			}
+			return nil
+		}
+		writeRespHeader(buf, this.Type, int64(len(this.Str)))
+		buf.Write(this.Str)
+		buf.WriteString("\r\n")
+
+	case RespArray, RespSet, RespPush, RespMap:
+		if this.Null {
+			if this.Type == RespArray {
+				buf.WriteString("*-1\r\n")
+			} else {
+				buf.WriteString("_\r\n")
+			}
+			return nil
+		}
+		n := len(this.Elems)
+		if this.Type == RespMap {
+			if n%2 != 0 {
+				return fmt.Errorf("RESP map must have even elements, got %d", n)
+			}
+			n = n / 2
+		}
+		writeRespHeader(buf, this.Type, int64(n))
+		for _, elem := range this.Elems {
+			if err := elem.writeTo(buf); err != nil {
+				return err
+			}
+		}
+
+	case RespNull:
+		buf.WriteString("_\r\n")
+
+	case RespBoolean:
+		if this.Bool {
+			buf.WriteString("#t\r\n")
+		} else {
+			buf.WriteString("#f\r\n")
+		}
+
+	case RespDouble:
+		buf.WriteByte(RespDouble)
+		switch {
+		case math.IsInf(this.Double, 1):
+			buf.WriteString("inf")
+		case math.IsInf(this.Double, -1):
+			buf.WriteString("-inf")
+		case math.IsNaN(this.Double):
+			buf.WriteString("nan")
+		default:
+			buf.WriteString(strconv.FormatFloat(this.Double, 'g', -1, 64))
+		}
+		buf.WriteString("\r\n")
+
+	default:
+		return fmt.Errorf("Unknown RESP type %q", this.Type)
+	}
+
+	return nil
+}
+
+type RespCodec struct {
+	TcpConn net.Conn
+	reader  *bufio.Reader
+
+	client        bool
+	maxBulkLength int
+	maxElements   int
+
+	//客户端模式下已经发出、还没有收到回应的心跳数，回应按内容识别，见isHeartBeatReply
+	pings int32
+}
+
+func NewRespCodec(tcpConn net.Conn, p *RespProtocol) *RespCodec {
+	codec := &RespCodec{
+		TcpConn:       tcpConn,
+		reader:        bufio.NewReader(tcpConn),
+		maxBulkLength: DefaultRespMaxBulkLength,
+		maxElements:   DefaultRespMaxElements,
+	}
+
+	if p != nil {
+		codec.client = p.Client
+		if p.MaxBulkLength > 0 {
+			codec.maxBulkLength = p.MaxBulkLength
+		}
+		if p.MaxElements > 0 {
+			codec.maxElements = p.MaxElements
+		}
+	}
+
+	return codec
+}
+
+//读取一行（包含结尾的'\n'），超过respMaxLineLength返回ErrorRespTooLarge
+func (this *RespCodec) readRawLine() ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := this.reader.ReadSlice('\n')
+		if len(line)+len(frag) > respMaxLineLength {
+			return nil, ErrorRespTooLarge
+		}
+		line = append(line, frag...)
+		if err == nil {
+			return line, nil
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+}
+
+//读取一行并去掉结尾的"\r\n"
+func (this *RespCodec) readLine() ([]byte, error) {
+	line, err := this.readRawLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrorRespProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+func (this *RespCodec) readLength(line []byte, max int) (int, error) {
+	n, err := strconv.ParseInt(string(line), 10, 64)
+	if err != nil || n < -1 {
+		return 0, ErrorRespProtocol
+	}
+	if n > int64(max) {
+		return 0, ErrorRespTooLarge
+	}
+	return int(n), nil
+}
+
+//telnet风格的inline命令，如"PING\r\n"，按空白分割成bulk string的array
+func (this *RespCodec) readInline() (*RespValue, error) {
+	line, err := this.readRawLine()
+	if err != nil {
+		return nil, err
+	}
+
+	value := &RespValue{Type: RespArray, Inline: true}
+	for _, field := range bytes.Fields(line) {
+		value.Elems = append(value.Elems, NewRespBulk(field))
+	}
+	return value, nil
+}
+
+//读取n字节的bulk string和结尾的"\r\n"；对端声明的长度不可信，较大时按块读取，实际收到多少数据才分配多少内存
+func (this *RespCodec) readBulk(n int) ([]byte, error) {
+	if n+2 <= respBulkChunk {
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(this.reader, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(respBulkChunk)
+	if _, err := io.CopyN(&buf, this.reader, int64(n+2)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (this *RespCodec) readValue(depth int) (*RespValue, error) {
+	if depth > respMaxDepth {
+		return nil, ErrorRespTooLarge
+	}
+
+	line, err := this.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, ErrorRespProtocol
+	}
+
+	value := &RespValue{Type: line[0]}
+	payload := line[1:]
+
+	switch value.Type {
+	case RespSimpleString, RespError, RespBigNumber:
+		value.Str = append([]byte(nil), payload...)
+
+	case RespInteger:
+		if value.Int, err = strconv.ParseInt(string(payload), 10, 64); err != nil {
+			return nil, ErrorRespProtocol
+		}
+
+	case RespBulkString, RespBulkError, RespVerbatim:
+		n, err := this.readLength(payload, this.maxBulkLength)
+		if err != nil {
+			return nil, err
+		}
+		if n == -1 {
+			value.Null = true
+			return value, nil
+		}
+		data, err := this.readBulk(n)
+		if err != nil {
+			return nil, err
+		}
+		if data[n] != '\r' || data[n+1] != '\n' {
+			return nil, ErrorRespProtocol
+		}
+		value.Str = data[:n]
+
+	case RespArray, RespSet, RespPush, RespMap, RespAttribute:
+		n, err := this.readLength(payload, this.maxElements)
+		if err != nil {
+			return nil, err
+		}
+		if n == -1 {
+			value.Null = true
+			return value, nil
+		}
+		if value.Type == RespMap || value.Type == RespAttribute {
+			if n > this.maxElements/2 {
+				return nil, ErrorRespTooLarge
+			}
+			n = n * 2
+		}
+		elems := make([]*RespValue, n)
+		for i := 0; i < n; i++ {
+			if elems[i], err = this.readValue(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+
+		//attribute附在紧跟着的那个值上
+		if value.Type == RespAttribute {
+			next, err := this.readValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			next.Attrs = elems
+			return next, nil
+		}
+		value.Elems = elems
+
+	case RespNull:
+		value.Null = true
+
+	case RespBoolean:
+		switch string(payload) {
+		case "t":
+			value.Bool = true
+		case "f":
+			value.Bool = false
+		default:
+			return nil, ErrorRespProtocol
+		}
+
+	case RespDouble:
+		switch string(payload) {
+		case "inf":
+			value.Double = math.Inf(1)
+		case "-inf":
+			value.Double = math.Inf(-1)
+		case "nan":
+			value.Double = math.NaN()
+		default:
+			if value.Double, err = strconv.ParseFloat(string(payload), 64); err != nil {
+				return nil, ErrorRespProtocol
+			}
+		}
+
+	default:
+		return nil, ErrorRespProtocol
+	}
+
+	return value, nil
+}
+
+func (this *RespCodec) Read() (msg Message, e error) {
+	first, err := this.reader.Peek(1)
+	if err != nil {
+		log.Println("RespCodec Read Err :", err.Error())
+		return nil, err
+	}
+
+	var value *RespValue
+	switch first[0] {
+	case RespSimpleString, RespError, RespInteger, RespBulkString, RespArray,
+		RespNull, RespBoolean, RespDouble, RespBigNumber, RespBulkError,
+		RespVerbatim, RespMap, RespSet, RespAttribute, RespPush:
+		value, err = this.readValue(0)
+	default:
+		//服务端模式下兼容telnet之类直接发送的inline命令
+		if this.client {
+			err = ErrorRespProtocol
+		} else {
+			value, err = this.readInline()
+		}
+	}
+
+	if err != nil {
+		log.Println("RespCodec Read Err :", err.Error())
+		return nil, err
+	}
+
+	//客户端模式下识别心跳PING的回应；按内容识别，pipeline、订阅推送和MONITOR不影响
+	if this.client && atomic.LoadInt32(&this.pings) > 0 && isHeartBeatReply(value) {
+		atomic.AddInt32(&this.pings, -1)
+		return &HeartBeat{Ping: false}, nil
+	}
+
+	return value, nil
+}
+
+//"PING token"的回应：一般为bulk string的token，RESP2订阅模式下为["pong", token]
+func isHeartBeatReply(value *RespValue) bool {
+	switch value.Type {
+	case RespBulkString:
+		return !value.Null && string(value.Str) == respHeartBeatToken
+	case RespArray, RespPush:
+		return len(value.Elems) == 2 &&
+			bytes.EqualFold(value.Elems[0].Str, []byte("pong")) &&
+			string(value.Elems[1].Str) == respHeartBeatToken
+	default:
+		return false
+	}
+}
+
+func (this *RespCodec) Write(msg Message) (n int, err error) {
+	buffer, err := msg.Serialize()
+	if err != nil {
+		return 0, err
+	}
+	//先计数再写出，否则回应可能在计数之前就被读协程读到，当成业务数据交给OnMessageData
+	_, heartbeat := msg.(*respPing)
+	if heartbeat {
+		atomic.AddInt32(&this.pings, 1)
+	}
+	n, err = this.TcpConn.Write(buffer)
+	if heartbeat && err != nil {
+		atomic.AddInt32(&this.pings, -1)
+	}
+	return n, err
+}
+
+func (this *RespCodec) WriteBinary(msg []byte) (n int, err error) {
+	return this.TcpConn.Write(msg)
+}
+
+//心跳请求，和普通的PING命令区分开，回应时才能识别出来
+type respPing struct{}
+
+func (this *respPing) Serialize() ([]byte, error) {
+	return NewRespCommand("PING", respHeartBeatToken).Serialize()
+}
+
+//只有客户端才能发送PING，服务端没有主动发起请求的方式
+func (this *RespCodec) NewHeartBeat() Message {
+	if !this.client {
+		return nil
+	}
+	return &respPing{}
+}
+
+func (this *RespCodec) Close() error {
+	return this.TcpConn.Close()
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+//客户端模式下只有内容是心跳token的回应才当作心跳，其他回应照常交给业务层
+func TestRespHeartBeatReply(t *testing.T) {
+	tests := []struct {
+		name      string
+		pings     int32
+		input     string
+		heartBeat bool
+	}{
+		{"bulk token", 1, "$17\r\ndovenet-heartbeat\r\n", true},
+		{"resp2 pubsub pong", 1, "*2\r\n$4\r\npong\r\n$17\r\ndovenet-heartbeat\r\n", true},
+		{"resp3 push pong", 1, ">2\r\n$4\r\npong\r\n$17\r\ndovenet-heartbeat\r\n", true},
+		{"no ping sent", 0, "$17\r\ndovenet-heartbeat\r\n", false},
+		{"plain pong", 1, "+PONG\r\n", false},
+		{"other bulk", 1, "$5\r\nhello\r\n", false},
+		{"pubsub message", 1, "*3\r\n$7\r\nmessage\r\n$1\r\nc\r\n$17\r\ndovenet-heartbeat\r\n", false},
+	}
+
+	for _, test := range tests {
+		codec := NewRespCodec(nil, &RespProtocol{Client: true})
+		codec.reader.Reset(strings.NewReader(test.input))
+		codec.pings = test.pings
+
+		msg, err := codec.Read()
+		if err != nil {
+			t.Errorf("%s: read: %v", test.name, err)
+			continue
+		}
+		hb, ok := msg.(*HeartBeat)
+		if ok != test.heartBeat {
+			t.Errorf("%s: read %T, want heartbeat %v", test.name, msg, test.heartBeat)
+			continue
+		}
+		if ok && hb.Ping {
+			t.Errorf("%s: pong read as ping", test.name)
+		}
+		if want := test.pings; ok && codec.pings != want - 1 || !ok && codec.pings != want {
+			t.Errorf("%s: pings = %d", test.name, codec.pings)
+		}
+	}
+}
+
+//心跳写出之前就计数，写失败时撤销
+func TestRespHeartBeatWrite(t *testing.T) {
+	client, server := net.Pipe()
+	codec := NewRespCodec(client, &RespProtocol{Client: true})
+
+	done := make(chan []byte)
+	go func() {
+		buffer := make([]byte, 256)
+		n, _ := server.Read(buffer)
+		done <- buffer[:n]
+	}()
+	if _, err := codec.Write(codec.NewHeartBeat()); err != nil {
+		t.Fatal(err)
+	}
+	if wire := <-done; !bytes.Contains(wire, []byte(respHeartBeatToken)) {
+		t.Errorf("heartbeat wire = %q", wire)
+	}
+	if codec.pings != 1 {
+		t.Errorf("pings after write = %d, want 1", codec.pings)
+	}
+
+	server.Close()
+	if _, err := codec.Write(codec.NewHeartBeat()); err == nil {
+		t.Fatal("write to closed pipe succeeded")
+	}
+	if codec.pings != 1 {
+		t.Errorf("pings after failed write = %d, want 1", codec.pings)
+	}
+	client.Close()
+}
+
+//服务端没有主动心跳
+func TestRespServerHeartBeat(t *testing.T) {
+	if msg := NewRespCodec(nil, &RespProtocol{}).NewHeartBeat(); msg != nil {
+		t.Errorf("server NewHeartBeat = %v, want nil", msg)
+	}
+}
@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	log "github.com/sotter/dovenet/log"
+)
+
+const DefaultVarintMaxLength = 1 << 23 // 8M
+
+//心跳使用长度0的非最简varint编码，正常的编码器不会生成，和长度为0的空包区分开；
+//只认识最简编码的对端读到的是空包，不会破坏分包
+var (
+	varintPing = []byte{0x80, 0x00}
+	varintPong = []byte{0x80, 0x80, 0x00}
+)
+
+var ErrorVarintOverflow error = errors.New("Varint length overflows a 64-bit integer")
+
+//varint长度前缀的包，和protobuf的writeDelimitedTo格式一致
+type VarintMsg struct {
+	Body []byte
+}
+
+func NewVarintMsg(body []byte) *VarintMsg {
+	return &VarintMsg{
+		Body: body,
+	}
+}
+
+func (this *VarintMsg) Size() int {
+	var buffer [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buffer[:], uint64(len(this.Body))) + len(this.Body)
+}
+
+func (this *VarintMsg) Serialize() ([]byte, error) {
+	buffer := make([]byte, binary.MaxVarintLen64+len(this.Body))
+	n := binary.PutUvarint(buffer, uint64(len(this.Body)))
+	n += copy(buffer[n:], this.Body)
+	return buffer[:n], nil
+}
+
+type VarintCodec struct {
+	TcpConn   net.Conn
+	reader    *bufio.Reader
+	maxLength int
+}
+
+func NewVarintCodec(tcpConn net.Conn, p *VarintProtocol) *VarintCodec {
+	codec := &VarintCodec{
+		TcpConn:   tcpConn,
+		reader:    bufio.NewReader(tcpConn),
+		maxLength: DefaultVarintMaxLength,
+	}
+
+	if p != nil && p.MaxLength > 0 {
+		codec.maxLength = p.MaxLength
+	}
+
+	return codec
+}
+
+//和binary.ReadUvarint一样读取长度，同时返回编码占用的字节数，用于识别心跳
+func (this *VarintCodec) readLength() (uint64, int, error) {
+	var length uint64
+	var shift uint
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		b, err := this.reader.ReadByte()
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, i, err
+		}
+		if b < 0x80 {
+			if i == binary.MaxVarintLen64 - 1 && b > 1 {
+				return 0, i + 1, ErrorVarintOverflow
+			}
+			return length | uint64(b) << shift, i + 1, nil
+		}
+		length |= uint64(b & 0x7f) << shift
+		shift += 7
+	}
+	return 0, binary.MaxVarintLen64, ErrorVarintOverflow
+}
+
+func (this *VarintCodec) Read() (msg Message, e error) {
+	length, size, err := this.readLength()
+	if err != nil {
+		log.Println("VarintCodec Read Err :", err.Error())
+		return nil, err
+	}
+
+	if length == 0 {
+		switch size {
+		case len(varintPing):
+			return &HeartBeat{Ping: true, Reply: varintHeartBeat(varintPong)}, nil
+		case len(varintPong):
+			return &HeartBeat{Ping: false}, nil
+		}
+		return &VarintMsg{Body: []byte{}}, nil
+	}
+
+	if length > uint64(this.maxLength) {
+		return nil, fmt.Errorf("VarintCodec Read, body length %d exceeds %d", length, this.maxLength)
+	}
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(this.reader, body); err != nil {
+		log.Println("VarintCodec Read Err :", err.Error())
+		return nil, err
+	}
+
+	return &VarintMsg{Body: body}, nil
+}
+
+func (this *VarintCodec) Write(msg Message) (n int, err error) {
+	buffer, err := msg.Serialize()
+	if err != nil {
+		return 0, err
+	}
+	return this.TcpConn.Write(buffer)
+}
+
+func (this *VarintCodec) WriteBinary(msg []byte) (n int, err error) {
+	return this.TcpConn.Write(msg)
+}
+
+//心跳请求和回应，见varintPing
+type varintHeartBeat []byte
+
+func (this varintHeartBeat) Serialize() ([]byte, error) {
+	return this, nil
+}
+
+func (this *VarintCodec) NewHeartBeat() Message {
+	return varintHeartBeat(varintPing)
+}
+
+func (this *VarintCodec) Close() error {
+	return this.TcpConn.Close()
+}
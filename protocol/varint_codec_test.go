@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+//心跳请求、心跳回应和长度为0的空包互不混淆
+func TestVarintHeartBeat(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		ping  bool
+		pong  bool
+		body  []byte
+	}{
+		{"empty message", []byte{0x00}, false, false, []byte{}},
+		{"ping", varintPing, true, false, nil},
+		{"pong", varintPong, false, true, nil},
+		{"one byte", []byte{0x01, 'a'}, false, false, []byte("a")},
+		{"two byte length", append([]byte{0x80, 0x01}, bytes.Repeat([]byte("b"), 128)...), false, false, bytes.Repeat([]byte("b"), 128)},
+		{"overlong zero", []byte{0x80, 0x80, 0x80, 0x00}, false, false, []byte{}},
+	}
+
+	for _, test := range tests {
+		codec := NewVarintCodec(nil, nil)
+		codec.reader.Reset(bytes.NewReader(test.input))
+		msg, err := codec.Read()
+		if err != nil {
+			t.Errorf("%s: read: %v", test.name, err)
+			continue
+		}
+
+		if hb, ok := msg.(*HeartBeat); ok {
+			if hb.Ping != test.ping || !hb.Ping != test.pong {
+				t.Errorf("%s: heartbeat ping %v, want ping %v pong %v", test.name, hb.Ping, test.ping, test.pong)
+			}
+			//心跳请求要回应，并且回应能被识别为回应
+			if hb.Ping {
+				reply, _ := hb.Reply.Serialize()
+				if !bytes.Equal(reply, varintPong) {
+					t.Errorf("%s: reply %x, want %x", test.name, reply, varintPong)
+				}
+			}
+			continue
+		}
+		if test.ping || test.pong {
+			t.Errorf("%s: read %T, want heartbeat", test.name, msg)
+			continue
+		}
+		if vm, ok := msg.(*VarintMsg); !ok || !bytes.Equal(vm.Body, test.body) {
+			t.Errorf("%s: read %v, want body %q", test.name, msg, test.body)
+		}
+	}
+}
+
+func TestVarintEncoding(t *testing.T) {
+	codec := NewVarintCodec(nil, nil)
+	ping, _ := codec.NewHeartBeat().Serialize()
+	empty, _ := NewVarintMsg(nil).Serialize()
+	if bytes.Equal(ping, empty) {
+		t.Errorf("heartbeat %x encodes like an empty message", ping)
+	}
+	if !bytes.Equal(empty, []byte{0x00}) {
+		t.Errorf("empty message = %x, want 00", empty)
+	}
+}
+
+func TestVarintReadErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"truncated length", []byte{0x80}},
+		{"overflow", bytes.Repeat([]byte{0xff}, 11)},
+		{"too long", []byte{0x80, 0x80, 0x80, 0x08}},
+		{"truncated body", []byte{0x05, 'a'}},
+	}
+
+	for _, test := range tests {
+		codec := NewVarintCodec(nil, nil)
+		codec.reader.Reset(bytes.NewReader(test.input))
+		if msg, err := codec.Read(); err == nil {
+			t.Errorf("%s: read %v, want error", test.name, msg)
+		}
+	}
+}
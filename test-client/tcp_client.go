@@ -1,11 +1,13 @@
 package main
 
 import (
+	"flag"
 	"net"
 	"time"
 	log "github.com/sotter/dovenet/log"
 	"github.com/sotter/dovenet/base"
 	"github.com/sotter/dovenet/protocol"
+	"github.com/sotter/dovenet/discovery"
 )
 
 type ServiceClient struct {
@@ -40,7 +42,7 @@ func (this *ServiceClient) RegisterClient(name string, address string) {
 
 	//2. 生成TcpConnection
 	protocol := protocol.CommProtocol{}
-	tcpConn := base.NewClientConn(base.GetNetId(),  protocol.NewCodec(dest.(*net.TCPConn)), this.ChanSize, this)
+	tcpConn := base.NewClientConn(base.GetNetId(),  protocol.NewCodec(dest), this.ChanSize, this)
 	tcpConn.Name = name
 	tcpConn.Address = address
 	tcpConn.WorkNum = 1     //每一种类型的建立一个连接
@@ -103,8 +105,23 @@ func (this *ServiceClient) DoHeartBeatLoop(name string, connId uint64) {
 }
 
 func main() {
+	config := flag.String("config", "", "服务发现的配置文件(json/yaml)，为空时直接连接127.0.0.1:8000")
+	conns := flag.Int("conns", 1, "使用-config时每个地址最多的连接数，发送队列积压时自动增加，空闲时回收")
+	flag.Parse()
+
 	test_client := NewServiceClient(1024)
-	test_client.RegisterClient("ctl_client", "127.0.0.1:8000")
+	if *config != "" {
+		//由TransPortClient根据配置文件建立和维护连接，配置文件修改后自动生效
+		test_client.Transport.NetworkCB = test_client
+		test_client.Transport.ChanSize = test_client.ChanSize
+		test_client.Transport.SetDefaultPoolPolicy(base.PoolPolicy{Min: 1, Max: *conns})
+		watcher := discovery.NewWatcher(discovery.NewFileResolver(*config), test_client.Transport, 5*time.Second)
+		if err := watcher.Start(); err != nil {
+			log.Print("Watcher Start ", err.Error())
+		}
+	} else {
+		test_client.RegisterClient("ctl_client", "127.0.0.1:8000")
+	}
 
 	select {
 
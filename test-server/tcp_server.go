@@ -7,7 +7,6 @@ import (
 	"github.com/sotter/dovenet/protocol"
 	log "github.com/sotter/dovenet/log"
 	"time"
-	"net"
 	"runtime"
 	"net/http"
 )
@@ -68,16 +67,8 @@ func (this *TestServer)Loop() {
 
 		tcpConn.SetReadDeadline(time.Now().Add(time.Minute*4))
 
-		tcpConnection:= base.NewServerConn(
-			base.GetNetId(),
-			this.TcpServer.Protocol.NewCodec(tcpConn.(* net.TCPConn)),
-			&session,
-			this.TcpServer.Manager)
-
-		tcpConnection.Address = tcpConn.RemoteAddr().String()
-		tcpConnection.NetworkCB = &session
+		tcpConnection := this.TcpServer.NewSession(tcpConn, &session)
 		session.TcpConn = tcpConnection
-		tcpConnection.ConnManager  = this.TcpServer.Manager
 
 		tcpConnection.Start()
 	}
@@ -89,6 +80,16 @@ func main() {
 	}()
 
 	tcp_server, _ := base.NewTCPServer(":8000", &protocol.CommProtocol{})
+	//单个连接每秒最多10000个消息、16M字节，超过时暂停读
+	tcp_server.SetInboundPolicy(&base.InboundPolicy{
+		PerConn : base.InboundLimit{MsgRate: 10000, ByteRate: 16 * 1024 * 1024},
+		Action  : base.INBOUND_DELAY,
+	})
+	//最多MAX_CONNECTIONS个连接，同一个IP最多100个，超过时回复服务繁忙
+	tcp_server.SetAdmissionPolicy(&base.AdmissionPolicy{
+		MaxPerIP : 100,
+		Mode     : base.ADMIT_BUSY,
+	})
 	test_server := TestServer {
 		ServerNumber : 1234,
 		TcpServer    : tcp_server,